@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stefanprodan/xmicro/xproxy"
+	"github.com/stefanprodan/xmicro/xserver"
+)
+
+// proxyHealth is the proxy health report
+type proxyHealth struct {
+	*AppContext
+	Draining bool           `json:"draining"`
+	Registry registryHealth `json:"registry"`
+}
+
+// registryHealth reports the registry snapshot served by the proxy
+type registryHealth struct {
+	Version    uint64  `json:"version"`
+	Stale      bool    `json:"stale"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// StartAdmin starts the proxy admin server, all endpoints except /ping, /health and /metrics require the admin token
+func StartAdmin(address string, token string, proxy *xproxy.ReverseProxy, config xserver.Config) {
+	if token == "" {
+		log.Warn("Admin token not set, admin endpoints other than /ping, /health and /metrics are disabled")
+	}
+	admin := func(handler http.HandlerFunc) http.Handler {
+		return AdminTokenMiddleware(token, handler)
+	}
+
+	mux := new(http.ServeMux)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {
+		appCtx.Render.Text(w, http.StatusOK, "pong")
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		status := http.StatusOK
+		if proxy.Draining() {
+			status = http.StatusServiceUnavailable
+		}
+		snapshot := proxy.ServiceRegistry.Snapshot()
+		appCtx.Render.JSON(w, status, proxyHealth{
+			AppContext: appCtx,
+			Draining:   proxy.Draining(),
+			Registry: registryHealth{
+				Version:    snapshot.Version,
+				Stale:      snapshot.Stale,
+				AgeSeconds: snapshot.Age().Seconds(),
+			},
+		})
+	})
+	mux.Handle("/error", admin(func(w http.ResponseWriter, req *http.Request) {
+		appCtx.Render.Text(w, http.StatusNotAcceptable, "Not Acceptable")
+	}))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/registry", admin(func(w http.ResponseWriter, req *http.Request) {
+		appCtx.Render.JSON(w, http.StatusOK, proxy.ServiceRegistry.Snapshot())
+	}))
+	mux.Handle("/registry/resync", admin(func(w http.ResponseWriter, req *http.Request) {
+		if !requireMethod(w, req, http.MethodPost) {
+			return
+		}
+		if err := proxy.Resync(); err != nil {
+			appCtx.Render.JSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		appCtx.Render.JSON(w, http.StatusOK, proxy.ServiceRegistry.Snapshot())
+	}))
+	mux.Handle("/registry/changes", admin(registryChangesHandler(&proxy.ServiceRegistry, config.WriteTimeout)))
+	mux.Handle("/registry/events", admin(registryStreamHandler(&proxy.ServiceRegistry, config.WriteTimeout)))
+	mux.Handle("/services/", admin(func(w http.ResponseWriter, req *http.Request) {
+		service := strings.TrimPrefix(req.URL.Path, "/services/")
+		status, err := proxy.ServiceRegistry.Status(service)
+		if err != nil {
+			appCtx.Render.JSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		appCtx.Render.JSON(w, http.StatusOK, status)
+	}))
+	mux.Handle("/leaders", admin(func(w http.ResponseWriter, req *http.Request) {
+		appCtx.Render.JSON(w, http.StatusOK, proxy.ServiceRegistry.Snapshot().Leaders)
+	}))
+	mux.Handle("/config", admin(func(w http.ResponseWriter, req *http.Request) {
+		appCtx.Render.JSON(w, http.StatusOK, proxyConfig(proxy))
+	}))
+	mux.Handle("/endpoints/disable", admin(endpointToggle(proxy, true)))
+	mux.Handle("/endpoints/enable", admin(endpointToggle(proxy, false)))
+	mux.Handle("/drain", admin(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			proxy.SetDraining(true)
+		case http.MethodDelete:
+			proxy.SetDraining(false)
+		case http.MethodGet:
+		default:
+			appCtx.Render.Text(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+			return
+		}
+		appCtx.Render.JSON(w, http.StatusOK, map[string]bool{"draining": proxy.Draining()})
+	}))
+
+	server := xserver.New("admin", address, mux, config)
+	log.Printf("Admin started on %s", address)
+	log.Fatal(server.ListenAndServe())
+}
+
+// AdminTokenMiddleware rejects requests without the admin token in the Authorization bearer or X-Admin-Token header
+func AdminTokenMiddleware(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			appCtx.Render.Text(w, http.StatusForbidden, "Admin token not configured")
+			return
+		}
+		provided := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); provided == "" && strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			appCtx.Render.Text(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// endpointToggle disables or enables the endpoint specified by the service and endpoint query params
+func endpointToggle(proxy *xproxy.ReverseProxy, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !requireMethod(w, req, http.MethodPost) {
+			return
+		}
+		service := req.URL.Query().Get("service")
+		endpoint := req.URL.Query().Get("endpoint")
+		if service == "" || endpoint == "" {
+			appCtx.Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "service and endpoint are required"})
+			return
+		}
+		proxy.ServiceRegistry.SetEndpointDisabled(service, endpoint, disabled)
+		log.Infof("Endpoint %s of %s disabled %v", endpoint, service, disabled)
+		status, err := proxy.ServiceRegistry.Status(service)
+		if err != nil {
+			appCtx.Render.JSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		appCtx.Render.JSON(w, http.StatusOK, status)
+	}
+}
+
+// proxyConfig returns the flags, with secrets redacted, and the routes and policies loaded from Consul
+func proxyConfig(proxy *xproxy.ReverseProxy) map[string]interface{} {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if strings.Contains(strings.ToLower(f.Name), "token") && value != "" {
+			value = "<redacted>"
+		}
+		flags[f.Name] = value
+	})
+	config := map[string]interface{}{
+		"flags":    flags,
+		"routes":   proxy.Routes.All(),
+		"draining": proxy.Draining(),
+	}
+	if proxy.Intentions != nil {
+		config["intentions"] = proxy.Intentions.All()
+	}
+	if proxy.IPFilter != nil {
+		config["ip_rules"] = proxy.IPFilter.All()
+	}
+	return config
+}
+
+func requireMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		appCtx.Render.Text(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return false
+	}
+	return true
+}
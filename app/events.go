@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stefanprodan/xmicro/xproxy"
+)
+
+// registryChanges is the long-poll response, Resync is set when the requested version is too old
+// and the client must reload the registry before polling again from Version
+type registryChanges struct {
+	Version uint64         `json:"version"`
+	Resync  bool           `json:"resync"`
+	Events  []xproxy.Event `json:"events"`
+}
+
+// registryChangesHandler returns the registry events newer than the index query param,
+// waiting up to the wait query param, 30s by default, for new events
+func registryChangesHandler(registry *xproxy.Registry, writeTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		wait := 30 * time.Second
+		if value := req.URL.Query().Get("wait"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				appCtx.Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid wait duration"})
+				return
+			}
+			wait = d
+		}
+		// answer before the server write timeout closes the connection
+		if writeTimeout > 0 && wait > writeTimeout-time.Second {
+			wait = writeTimeout - time.Second
+		}
+
+		value := req.URL.Query().Get("index")
+		if value == "" {
+			// first poll, the client starts from the current version
+			version := registry.Snapshot().Version
+			w.Header().Set(xproxy.RegistryVersionHeader, strconv.FormatUint(version, 10))
+			appCtx.Render.JSON(w, http.StatusOK, registryChanges{Version: version, Events: []xproxy.Event{}})
+			return
+		}
+		index, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			appCtx.Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid index"})
+			return
+		}
+
+		events, ok := registry.WaitEvents(index, wait)
+		changes := registryChanges{Version: index, Resync: !ok, Events: events}
+		if !ok {
+			changes.Version = registry.Snapshot().Version
+			changes.Events = []xproxy.Event{}
+		} else if len(events) > 0 {
+			changes.Version = events[len(events)-1].Version
+		}
+		w.Header().Set(xproxy.RegistryVersionHeader, strconv.FormatUint(changes.Version, 10))
+		appCtx.Render.JSON(w, http.StatusOK, changes)
+	}
+}
+
+// registryStreamHandler streams the registry events as Server-Sent Events.
+// The stream resumes after the Last-Event-ID header or the index query param and
+// is closed before the server write timeout, clients reconnect with the last event id.
+func registryStreamHandler(registry *xproxy.Registry, writeTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			appCtx.Render.Text(w, http.StatusInternalServerError, "Streaming not supported")
+			return
+		}
+
+		events, cancel := registry.Subscribe(1024)
+		defer cancel()
+
+		last := registry.Snapshot().Version
+		value := req.Header.Get("Last-Event-ID")
+		if value == "" {
+			value = req.URL.Query().Get("index")
+		}
+		var replay []xproxy.Event
+		resync := false
+		if value != "" {
+			index, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				appCtx.Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid event id"})
+				return
+			}
+			replay, ok = registry.Events(index)
+			resync = !ok
+			last = index
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 1000\n\n")
+		if resync {
+			last = registry.Snapshot().Version
+			fmt.Fprintf(w, "id: %v\nevent: resync\ndata: {\"version\":%v}\n\n", last, last)
+		}
+		for _, e := range replay {
+			writeEvent(w, e)
+			last = e.Version
+		}
+		flusher.Flush()
+
+		var deadline <-chan time.Time
+		if writeTimeout > 0 {
+			timer := time.NewTimer(writeTimeout - time.Second)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					// the stream fell behind, the client must reload the registry
+					version := registry.Snapshot().Version
+					fmt.Fprintf(w, "id: %v\nevent: resync\ndata: {\"version\":%v}\n\n", version, version)
+					flusher.Flush()
+					return
+				}
+				if e.Version <= last {
+					// already replayed or part of the version the client loaded
+					continue
+				}
+				writeEvent(w, e)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			case <-deadline:
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes the event in the Server-Sent Events format, the id is the registry version
+func writeEvent(w http.ResponseWriter, e xproxy.Event) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %v\nevent: %s\ndata: %s\n\n", e.Version, e.Type, data)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stefanprodan/xmicro/xconsul"
+	"github.com/stefanprodan/xmicro/xserver"
+)
+
+// leader modes of the requests received by a non-leader instance
+const (
+	leaderLocal    = "local"
+	leaderForward  = "forward"
+	leaderRedirect = "redirect"
+)
+
+// leaderRule applies the mode to the requests matching the path prefix and one of the methods, any method if none
+type leaderRule struct {
+	prefix  string
+	methods map[string]bool
+	mode    string
+}
+
+// leaderPolicy decides how a non-leader instance handles a request,
+// reads are served locally and writes get the default mode unless a route rule matches
+type leaderPolicy struct {
+	// writes is the mode of POST, PUT, PATCH and DELETE requests
+	writes string
+	// rules sorted by prefix length, longest first
+	rules  []leaderRule
+	scheme string
+
+	// the endpoint of the leader, looked up again when the leader changes or forwarding to it fails
+	lock     sync.Mutex
+	leader   string
+	endpoint string
+}
+
+// parseLeaderRules parses the route rules, format: /prefix=mode,/prefix:METHOD|METHOD=mode
+func parseLeaderRules(value string) ([]leaderRule, error) {
+	rules := make([]leaderRule, 0)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") || !validLeaderMode(kv[1]) {
+			return nil, fmt.Errorf("invalid leader rule %s, format: /prefix:METHOD|METHOD=local|forward|redirect", pair)
+		}
+		rule := leaderRule{prefix: kv[0], mode: kv[1]}
+		if n := strings.Index(kv[0], ":"); n >= 0 {
+			rule.prefix = kv[0][:n]
+			rule.methods = make(map[string]bool)
+			for _, method := range strings.Split(kv[0][n+1:], "|") {
+				rule.methods[strings.ToUpper(method)] = true
+			}
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	return rules, nil
+}
+
+// validLeaderMode returns true if the mode is local, forward or redirect
+func validLeaderMode(mode string) bool {
+	return mode == leaderLocal || mode == leaderForward || mode == leaderRedirect
+}
+
+// mode returns the mode of the request, the first matching rule wins
+func (p *leaderPolicy) mode(r *http.Request) string {
+	for _, rule := range p.rules {
+		if strings.HasPrefix(r.URL.Path, rule.prefix) && (rule.methods == nil || rule.methods[r.Method]) {
+			return rule.mode
+		}
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return p.writes
+	}
+	return leaderLocal
+}
+
+// leaderEndpoint returns the leader and its endpoint, the catalog is queried only when the leader changes
+// or the cached endpoint was invalidated
+func (p *leaderPolicy) leaderEndpoint(election *xconsul.Election) (string, string, error) {
+	leader := election.GetLeader()
+	if leader == "" {
+		return "", "", xconsul.ErrNoLeader
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if leader == p.leader && p.endpoint != "" {
+		return leader, p.endpoint, nil
+	}
+	endpoint, err := election.LeaderEndpoint()
+	if err != nil {
+		return "", "", err
+	}
+	p.leader, p.endpoint = leader, endpoint
+	return leader, endpoint, nil
+}
+
+// invalidate drops the cached endpoint if it still points to the leader at the endpoint,
+// e.g. the leader restarted under the same name with a new address
+func (p *leaderPolicy) invalidate(leader string, endpoint string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.leader == leader && p.endpoint == endpoint {
+		p.leader, p.endpoint = "", ""
+	}
+}
+
+// LeaderMiddleware serves all requests on the leader, on the other instances the request is served locally,
+// forwarded to the leader or redirected to it with 307 depending on the policy of its route and method.
+// A forwarded request reaching an instance that is not the leader is rejected with 503 instead of looping.
+// The election is read from the context set by ElectionMiddleware.
+func LeaderMiddleware(policy *leaderPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		election := r.Context().Value(electionContextKey).(*xconsul.Election)
+		mode := policy.mode(r)
+		if mode == leaderLocal || election.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if hop := r.Header.Get(xconsul.LeaderHopHeader); hop != "" {
+			log.Warnf("Request forwarded by %s reached %s which is not the leader", hop, appCtx.Hostname)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable: leader changed", http.StatusServiceUnavailable)
+			return
+		}
+		leader, endpoint, err := policy.leaderEndpoint(election)
+		if err != nil {
+			log.Warnf("Leader lookup failed %s", err.Error())
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable: no leader", http.StatusServiceUnavailable)
+			return
+		}
+		if mode == leaderRedirect {
+			http.Redirect(w, r, policy.scheme+"://"+endpoint+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		r.Header.Set(xconsul.LeaderHopHeader, appCtx.Hostname)
+		rproxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: policy.scheme, Host: endpoint})
+		rproxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, xserver.ErrBodyTooLarge) {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Warnf("Forwarding to leader %s at %s failed %s", leader, endpoint, err.Error())
+			policy.invalidate(leader, endpoint)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		}
+		rproxy.ServeHTTP(w, r)
+	})
+}
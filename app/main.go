@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -8,10 +9,13 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/stefanprodan/xmicro/xconsul"
 	"github.com/stefanprodan/xmicro/xproxy"
+	"github.com/stefanprodan/xmicro/xserver"
+	"github.com/stefanprodan/xmicro/xtoken"
 )
 
 type appFlags struct {
@@ -20,9 +24,69 @@ type appFlags struct {
 	role                     string
 	logLevel                 string
 	electionKeyPrefix        string
+	electionSlots            int
+	electionCooldown         time.Duration
+	electionStandby          string
+	electionPriority         int
+	electionHysteresis       time.Duration
+	electionRetry            time.Duration
+	electionMaxBackoff       time.Duration
+	leaderWrites             string
+	leaderRoutes             string
 	proxyScheme              string
 	proxyMaxIdleConnsPerHost int
 	proxyDisableKeepAlives   bool
+	serverReadHeaderTimeout  time.Duration
+	serverReadTimeout        time.Duration
+	serverWriteTimeout       time.Duration
+	serverIdleTimeout        time.Duration
+	serverMaxHeaderBytes     int
+	serverMaxBodyBytes       int64
+	serverRouteBodyLimits    string
+	serverMaxConns           int
+	serverMaxConnsPerIP      int
+	serverTLSCert            string
+	serverTLSKey             string
+	serverTLSClientCA        string
+	routesKeyPrefix          string
+	authJWKS                 string
+	authJWKSRefresh          time.Duration
+	authIssuer               string
+	authAudience             string
+	authAPIKeysPrefix        string
+	authClaimHeaders         string
+	intentionsKeyPrefix      string
+	intentionsMode           string
+	intentionsDefault        string
+	serviceKeysPrefix        string
+	identityService          string
+	identityTokenTTL         time.Duration
+	identityRequired         bool
+	identityAudience         string
+	internalPort             int
+	ipFiltersKeyPrefix       string
+	trustedProxies           string
+	adminPort                int
+	adminToken               string
+	healthPolicy             string
+	healthGracePeriod        time.Duration
+	healthPanicThreshold     float64
+	registryDebounce         time.Duration
+	discovery                string
+	discoveryFile            string
+	discoveryDNS             string
+	discoveryDNSInterval     time.Duration
+	discoveryEtcd            string
+	discoveryEtcdPrefix      string
+	consulDatacenters        string
+	crossDCElections         bool
+	locality                 bool
+	localityNode             string
+	localityZone             string
+	localityZoneKey          string
+	localitySpillover        float64
+	localityWeights          string
+	registrySnapshot         string
 }
 
 type stoppableService interface {
@@ -36,18 +100,101 @@ func main() {
 	flag.StringVar(&flags.role, "role", "proxy", "roles: proxy, frontend, backend, storage")
 	flag.StringVar(&flags.logLevel, "loglevel", "debug", "logging threshold level: debug|info|warn|error|fatal|panic")
 	flag.StringVar(&flags.electionKeyPrefix, "electionKeyPrefix", "xmicro/election/", "format: namespace/election/")
+	flag.IntVar(&flags.electionSlots, "electionSlots", 1, "number of instances of the role leading at the same time, more than 1 uses a Consul semaphore")
+	flag.DurationVar(&flags.electionCooldown, "electionCooldown", 10*time.Second, "time a leader stays out of the election after stepping down")
+	flag.StringVar(&flags.leaderWrites, "leaderWrites", "forward", "how non-leader instances handle writes: forward to the leader, redirect to it or local")
+	flag.StringVar(&flags.leaderRoutes, "leaderRoutes", "", "per route leader policy, format: /prefix=mode,/prefix:METHOD|METHOD=mode")
+	flag.IntVar(&flags.electionPriority, "electionPriority", 0, "election priority, the leader steps down to a ready instance with a higher priority")
+	flag.DurationVar(&flags.electionHysteresis, "electionHysteresis", 30*time.Second, "time a higher priority instance must be ready before the leader steps down to it")
+	flag.DurationVar(&flags.electionRetry, "electionRetry", 5*time.Second, "wait after a failed election attempt or leader watch query")
+	flag.DurationVar(&flags.electionMaxBackoff, "electionMaxBackoff", time.Minute, "max wait between retries, the wait doubles after every consecutive failure")
+	flag.StringVar(&flags.electionStandby, "electionStandby", "", "instance the leadership is handed to when the leader shuts down")
 	flag.StringVar(&flags.proxyScheme, "proxyScheme", "http", "proxy scheme: http or https")
 	flag.IntVar(&flags.proxyMaxIdleConnsPerHost, "proxyMaxIdleConnsPerHost", 500, "proxy max idle connections per host")
 	flag.BoolVar(&flags.proxyDisableKeepAlives, "proxyDisableKeepAlives", true, "proxy disable KeepAlive")
+	serverDefaults := xserver.DefaultConfig()
+	flag.DurationVar(&flags.serverReadHeaderTimeout, "serverReadHeaderTimeout", serverDefaults.ReadHeaderTimeout, "max time to read the request headers")
+	flag.DurationVar(&flags.serverReadTimeout, "serverReadTimeout", serverDefaults.ReadTimeout, "max time to read the whole request, 0 disables it")
+	flag.DurationVar(&flags.serverWriteTimeout, "serverWriteTimeout", serverDefaults.WriteTimeout, "max time to write the response, 0 disables it")
+	flag.DurationVar(&flags.serverIdleTimeout, "serverIdleTimeout", serverDefaults.IdleTimeout, "max time a keep-alive connection stays idle")
+	flag.IntVar(&flags.serverMaxHeaderBytes, "serverMaxHeaderBytes", serverDefaults.MaxHeaderBytes, "max size of the request headers in bytes")
+	flag.Int64Var(&flags.serverMaxBodyBytes, "serverMaxBodyBytes", serverDefaults.MaxBodyBytes, "max size of the request body in bytes, 0 disables it")
+	flag.StringVar(&flags.serverRouteBodyLimits, "serverRouteBodyLimits", "", "per route body limits, format: /prefix=bytes,/prefix=bytes")
+	flag.IntVar(&flags.serverMaxConns, "serverMaxConns", serverDefaults.MaxConns, "max concurrent connections per listener, 0 disables it")
+	flag.IntVar(&flags.serverMaxConnsPerIP, "serverMaxConnsPerIP", serverDefaults.MaxConnsPerIP, "max concurrent connections per client IP, 0 disables it")
+	flag.StringVar(&flags.serverTLSCert, "serverTLSCert", "", "TLS certificate file, empty disables TLS")
+	flag.StringVar(&flags.serverTLSKey, "serverTLSKey", "", "TLS private key file")
+	flag.StringVar(&flags.serverTLSClientCA, "serverTLSClientCA", "", "CA file used to verify client certificates, empty disables mTLS")
+	flag.StringVar(&flags.routesKeyPrefix, "routesKeyPrefix", "xmicro/routes/", "format: namespace/routes/")
+	flag.StringVar(&flags.authJWKS, "authJWKS", "", "JWKS file path or URL used to verify JWTs, empty disables JWT authentication")
+	flag.DurationVar(&flags.authJWKSRefresh, "authJWKSRefresh", 5*time.Minute, "JWKS reload interval")
+	flag.StringVar(&flags.authIssuer, "authIssuer", "", "required JWT issuer, empty skips the check")
+	flag.StringVar(&flags.authAudience, "authAudience", "", "required JWT audience, empty skips the check")
+	flag.StringVar(&flags.authAPIKeysPrefix, "authAPIKeysPrefix", "xmicro/apikeys/", "format: namespace/apikeys/")
+	flag.StringVar(&flags.authClaimHeaders, "authClaimHeaders", "sub=X-Auth-Subject", "claims forwarded upstream, format: claim=Header,claim=Header")
+	flag.StringVar(&flags.intentionsKeyPrefix, "intentionsKeyPrefix", "xmicro/intentions/", "format: namespace/intentions/")
+	flag.StringVar(&flags.intentionsMode, "intentionsMode", "enforce", "intentions mode: enforce, audit or off")
+	flag.StringVar(&flags.intentionsDefault, "intentionsDefault", "allow", "action when no intention matches: allow or deny")
+	flag.StringVar(&flags.serviceKeysPrefix, "serviceKeysPrefix", "xmicro/servicekeys/", "service token signing keys, format: namespace/servicekeys/")
+	flag.StringVar(&flags.identityService, "identityService", "xproxy", "service name the proxy signs identity tokens as, API roles only trust tokens issued by it")
+	flag.DurationVar(&flags.identityTokenTTL, "identityTokenTTL", 30*time.Second, "lifetime of the identity tokens injected by the proxy")
+	flag.BoolVar(&flags.identityRequired, "identityRequired", false, "API roles reject requests without a valid identity token")
+	flag.StringVar(&flags.identityAudience, "identityAudience", "", "service name the instance is registered as, identity tokens must be issued for it, the hostname if empty")
+	flag.IntVar(&flags.internalPort, "internalPort", 0, "proxy internal listener port, 0 disables it")
+	flag.StringVar(&flags.ipFiltersKeyPrefix, "ipFiltersKeyPrefix", "xmicro/ipfilters/", "format: namespace/ipfilters/")
+	flag.StringVar(&flags.trustedProxies, "trustedProxies", "", "CIDRs allowed to set X-Forwarded-For, format: 10.0.0.0/8,192.168.1.1")
+	flag.IntVar(&flags.adminPort, "adminPort", 8081, "proxy admin listener port")
+	flag.StringVar(&flags.adminToken, "adminToken", "", "token required by the proxy admin and the election endpoints, empty disables them")
+	flag.StringVar(&flags.healthPolicy, "healthPolicy", xproxy.HealthPolicyPassing, "routable endpoints: passing, warning (passing and warning) or any")
+	flag.DurationVar(&flags.healthGracePeriod, "healthGracePeriod", 30*time.Second, "new endpoints are routable until their first health check completes within this period")
+	flag.Float64Var(&flags.healthPanicThreshold, "healthPanicThreshold", 0.5, "min healthy fraction of a service, below it all endpoints are routed to, 0 disables panic mode")
+	flag.DurationVar(&flags.registryDebounce, "registryDebounce", 500*time.Millisecond, "quiet interval after which coalesced Consul catalog changes are applied")
+	flag.StringVar(&flags.discovery, "discovery", "consul", "service discovery backends, combine with commas: consul, file, dns, etcd")
+	flag.StringVar(&flags.discoveryFile, "discoveryFile", "services.yaml", "static discovery YAML or JSON file, reloaded on changes")
+	flag.StringVar(&flags.discoveryDNS, "discoveryDNS", "", "DNS SRV records, format: service=_http._tcp.service.example.com,service=record")
+	flag.DurationVar(&flags.discoveryDNSInterval, "discoveryDNSInterval", 30*time.Second, "DNS SRV records resolve interval")
+	flag.StringVar(&flags.discoveryEtcd, "discoveryEtcd", "http://127.0.0.1:2379", "etcd endpoints, format: http://host:2379,http://host:2379")
+	flag.StringVar(&flags.discoveryEtcdPrefix, "discoveryEtcdPrefix", "xmicro/services/", "etcd key prefix, format: namespace/services/")
+	flag.StringVar(&flags.consulDatacenters, "consulDatacenters", "", "Consul datacenters in failover priority order, local first, format: dc1,dc2")
+	flag.BoolVar(&flags.locality, "locality", false, "prefer the upstream endpoints on the proxy node and zone")
+	flag.StringVar(&flags.localityNode, "localityNode", "", "Consul node of the proxy, the local agent node if empty")
+	flag.StringVar(&flags.localityZone, "localityZone", "", "zone of the proxy, read from the local agent node meta if empty")
+	flag.StringVar(&flags.localityZoneKey, "localityZoneKey", "zone", "node meta key holding the zone")
+	flag.Float64Var(&flags.localitySpillover, "localitySpillover", 0.5, "minimum routable fraction of the node and zone endpoints before spilling over to the zone and other zones")
+	flag.StringVar(&flags.localityWeights, "localityWeights", "", "weights of the zones when spilling over, format: zone=weight,zone=weight")
+	flag.BoolVar(&flags.crossDCElections, "crossDCElections", false, "resolve leaders from the elections of all consulDatacenters")
+	flag.StringVar(&flags.registrySnapshot, "registrySnapshot", "", "file the proxy registry is persisted to and served from at boot until the first sync, empty disables it")
 	flag.Parse()
 
 	setLogLevel(flags.logLevel)
 
 	var (
-		election = &xconsul.Election{}
-		proxy    = &xproxy.ReverseProxy{
-			ServiceRegistry:     xproxy.Registry{},
-			ElectionKeyPrefix:   flags.electionKeyPrefix,
+		election                  = &xconsul.Election{}
+		electionCtx, stopElection = context.WithCancel(context.Background())
+		electionDone              = make(chan error, 1)
+		api                       *xserver.Server
+		keyring                   = xtoken.NewKeyring(flags.serviceKeysPrefix)
+		proxy                     = &xproxy.ReverseProxy{
+			ServiceRegistry: xproxy.Registry{
+				HealthPolicy:   flags.healthPolicy,
+				GracePeriod:    flags.healthGracePeriod,
+				PanicThreshold: flags.healthPanicThreshold,
+			},
+			ElectionKeyPrefix: flags.electionKeyPrefix,
+			RoutesKeyPrefix:   flags.routesKeyPrefix,
+			SnapshotPath:      flags.registrySnapshot,
+			Intentions: &xproxy.Intentions{
+				Prefix:        flags.intentionsKeyPrefix,
+				Mode:          flags.intentionsMode,
+				DefaultAction: flags.intentionsDefault,
+				Keyring:       keyring,
+			},
+			Identity: &xproxy.IdentitySigner{
+				Service: flags.identityService,
+				Keyring: keyring,
+				TTL:     flags.identityTokenTTL,
+			},
+			Keyring:             keyring,
 			Scheme:              flags.proxyScheme,
 			MaxIdleConnsPerHost: flags.proxyMaxIdleConnsPerHost,
 			DisableKeepAlives:   flags.proxyDisableKeepAlives,
@@ -59,27 +206,222 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	serverConfig, err := flags.serverConfig()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	log.Info("Starting xmicro " + appCtx.Hostname + " role " + appCtx.Role + " on port " + fmt.Sprintf("%v", appCtx.Port) + " in " + appCtx.Env + " mode. Work dir " + appCtx.WorkDir)
 
 	if appCtx.Role == "proxy" {
-		go StartProxy(fmt.Sprintf(":%v", appCtx.Port), proxy)
+		proxy.Discovery, err = flags.discoveries()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		proxy.Locality, err = flags.localityConfig()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		proxy.Auth, err = flags.authenticator()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		trustedProxies, err := xproxy.ParseCIDRs(strings.Split(flags.trustedProxies, ","))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		proxy.IPFilter = &xproxy.IPFilter{
+			Prefix:         flags.ipFiltersKeyPrefix,
+			TrustedProxies: trustedProxies,
+		}
+		internalAddress := ""
+		if flags.internalPort > 0 {
+			internalAddress = fmt.Sprintf(":%v", flags.internalPort)
+		}
+		// the registry, routes and intentions are set up before the listeners serve them
+		xproxy.RegisterMetrics()
+		proxy.ServiceRegistry.RegisterMetrics()
+		xserver.RegisterMetrics()
+		err = proxy.StartConsulSync()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		go StartProxy(fmt.Sprintf(":%v", appCtx.Port), internalAddress, proxy, serverConfig)
+		go StartAdmin(fmt.Sprintf(":%v", flags.adminPort), flags.adminToken, proxy, serverConfig)
 
 	} else {
-		election = xconsul.BeginElection(appCtx.Hostname, flags.electionKeyPrefix, appCtx.Role)
-		go StartAPI(fmt.Sprintf(":%v", appCtx.Port), election)
+		err = keyring.StartSync()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		identity := &identityVerifier{
+			keyring:  keyring,
+			issuer:   flags.identityService,
+			audience: flags.audience(),
+			required: flags.identityRequired,
+		}
+		election, err = xconsul.NewElection(appCtx.Hostname, flags.electionKeyPrefix, appCtx.Role, flags.electionSlots)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		election.SetPriority(flags.electionPriority, flags.electionHysteresis)
+		election.SetTimings(xconsul.Timings{
+			RetryInterval: flags.electionRetry,
+			MaxBackoff:    flags.electionMaxBackoff,
+		})
+		go func() {
+			electionDone <- election.Run(electionCtx)
+		}()
+		leader, err := flags.leaderPolicy(serverConfig)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		api = StartAPI(fmt.Sprintf(":%v", appCtx.Port), election, identity, leader, flags.adminToken, flags.electionCooldown, serverConfig)
 	}
 
 	// wait for OS signal
-	osChan := make(chan os.Signal)
+	osChan := make(chan os.Signal, 1)
 	signal.Notify(osChan, syscall.SIGINT, syscall.SIGTERM)
 	osSignal := <-osChan
-	log.Info("Stoping services. OS signal: %v", osSignal)
+	log.Infof("Stoping services. OS signal: %v", osSignal)
 	// stop services
 	if appCtx.Role == "proxy" {
 		stop(proxy)
 	} else {
-		stop(election)
+		// step down before the server stops, the standby takes over without waiting out the session
+		if err := election.StepDown(flags.electionCooldown, flags.electionStandby); err == nil {
+			log.Info("Leadership released")
+		}
+		stopElection()
+		if err := <-electionDone; err != nil {
+			log.Error(err.Error())
+		}
+		shutdown(api, serverConfig.WriteTimeout)
+		stop(keyring)
+	}
+}
+
+func (f appFlags) serverConfig() (xserver.Config, error) {
+	routeBodyLimits, err := xserver.ParseRouteLimits(f.serverRouteBodyLimits)
+	if err != nil {
+		return xserver.Config{}, err
+	}
+	return xserver.Config{
+		ReadHeaderTimeout: f.serverReadHeaderTimeout,
+		ReadTimeout:       f.serverReadTimeout,
+		WriteTimeout:      f.serverWriteTimeout,
+		IdleTimeout:       f.serverIdleTimeout,
+		MaxHeaderBytes:    f.serverMaxHeaderBytes,
+		MaxBodyBytes:      f.serverMaxBodyBytes,
+		RouteBodyLimits:   routeBodyLimits,
+		MaxConns:          f.serverMaxConns,
+		MaxConnsPerIP:     f.serverMaxConnsPerIP,
+		TLSCertFile:       f.serverTLSCert,
+		TLSKeyFile:        f.serverTLSKey,
+		TLSClientCAFile:   f.serverTLSClientCA,
+	}, nil
+}
+
+func (f appFlags) authenticator() (*xproxy.Authenticator, error) {
+	claimHeaders, err := xproxy.ParseClaimHeaders(f.authClaimHeaders)
+	if err != nil {
+		return nil, err
+	}
+	auth := &xproxy.Authenticator{
+		Issuer:        f.authIssuer,
+		Audience:      f.authAudience,
+		APIKeysPrefix: f.authAPIKeysPrefix,
+		ClaimHeaders:  claimHeaders,
+	}
+	if f.authJWKS != "" {
+		auth.JWKS, err = xproxy.NewJWKS(f.authJWKS, f.authJWKSRefresh)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return auth, nil
+}
+
+func (f appFlags) discoveries() ([]xproxy.Discovery, error) {
+	backends, err := xproxy.ParseDiscovery(f.discovery)
+	if err != nil {
+		return nil, err
+	}
+	discoveries := make([]xproxy.Discovery, 0, len(backends))
+	for _, backend := range backends {
+		switch backend {
+		case "consul":
+			discoveries = append(discoveries, &xproxy.ConsulDiscovery{
+				ElectionKeyPrefix:        f.electionKeyPrefix,
+				Datacenters:              f.datacenters(),
+				CrossDatacenterElections: f.crossDCElections,
+				Debounce:                 f.registryDebounce,
+			})
+		case "file":
+			discoveries = append(discoveries, &xproxy.FileDiscovery{Path: f.discoveryFile})
+		case "dns":
+			records, err := xproxy.ParseDNSRecords(f.discoveryDNS)
+			if err != nil {
+				return nil, err
+			}
+			discoveries = append(discoveries, &xproxy.DNSDiscovery{Records: records, Interval: f.discoveryDNSInterval})
+		case "etcd":
+			discoveries = append(discoveries, &xproxy.EtcdDiscovery{
+				Endpoints: strings.Split(f.discoveryEtcd, ","),
+				Prefix:    f.discoveryEtcdPrefix,
+			})
+		}
+	}
+	return discoveries, nil
+}
+
+func (f appFlags) localityConfig() (*xproxy.Locality, error) {
+	if !f.locality {
+		return nil, nil
+	}
+	weights, err := xproxy.ParseZoneWeights(f.localityWeights)
+	if err != nil {
+		return nil, err
+	}
+	return &xproxy.Locality{
+		Node:               f.localityNode,
+		Zone:               f.localityZone,
+		ZoneKey:            f.localityZoneKey,
+		SpilloverThreshold: f.localitySpillover,
+		Weights:            weights,
+	}, nil
+}
+
+func (f appFlags) leaderPolicy(config xserver.Config) (*leaderPolicy, error) {
+	if !validLeaderMode(f.leaderWrites) {
+		return nil, fmt.Errorf("invalid leaderWrites %s, valid modes: local, forward, redirect", f.leaderWrites)
+	}
+	rules, err := parseLeaderRules(f.leaderRoutes)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if config.TLSCertFile != "" {
+		scheme = "https"
+	}
+	return &leaderPolicy{writes: f.leaderWrites, rules: rules, scheme: scheme}, nil
+}
+
+func (f appFlags) audience() string {
+	if f.identityAudience != "" {
+		return f.identityAudience
+	}
+	return appCtx.Hostname
+}
+
+func (f appFlags) datacenters() []string {
+	datacenters := make([]string, 0)
+	for _, dc := range strings.Split(f.consulDatacenters, ",") {
+		if dc = strings.TrimSpace(dc); dc != "" {
+			datacenters = append(datacenters, dc)
+		}
+	}
+	return datacenters
 }
 
 func stop(services ...stoppableService) {
@@ -89,6 +431,17 @@ func stop(services ...stoppableService) {
 	}
 }
 
+func shutdown(server *xserver.Server, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Server %s shutdown failed %s", server.Name, err.Error())
+	}
+}
+
 func setLogLevel(levelname string) {
 	level, err := log.ParseLevel(levelname)
 	if err != nil {
@@ -4,35 +4,27 @@ import (
 	"net/http"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stefanprodan/xmicro/xproxy"
+	"github.com/stefanprodan/xmicro/xserver"
 )
 
-// StartProxy starts the HTTP Reverse Proxy server backed by Consul
-func StartProxy(address string, proxy *xproxy.ReverseProxy) {
+// StartProxy starts the HTTP Reverse Proxy server backed by Consul, the Consul sync must be started first.
+// All paths are proxied, operational endpoints are served by the admin listener.
+// If an internal address is specified, a second listener is started for internal callers,
+// requests are tagged with the listener name so IP rules can target the public one.
+func StartProxy(address string, internalAddress string, proxy *xproxy.ReverseProxy, config xserver.Config) {
+	mux := new(http.ServeMux)
+	mux.HandleFunc("/", proxy.ReverseHandlerFunc())
 
-	xproxy.RegisterMetrics()
-	err := proxy.StartConsulSync()
-	if err != nil {
-		log.Fatal(err.Error())
+	if internalAddress != "" {
+		internal := xserver.New("proxy-internal", internalAddress, xproxy.ListenerMiddleware("internal", mux), config)
+		go func() {
+			log.Printf("Internal proxy started on %s", internalAddress)
+			log.Fatal(internal.ListenAndServe())
+		}()
 	}
 
-	http.HandleFunc("/", proxy.ReverseHandlerFunc())
-	http.HandleFunc("/registry", func(w http.ResponseWriter, req *http.Request) {
-		appCtx.Render.JSON(w, http.StatusOK, proxy.ServiceRegistry)
-	})
-	http.HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {
-		appCtx.Render.Text(w, http.StatusOK, "pong")
-	})
-	http.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
-		appCtx.Render.JSON(w, http.StatusOK, appCtx)
-	})
-	http.HandleFunc("/error", func(w http.ResponseWriter, req *http.Request) {
-		appCtx.Render.Text(w, http.StatusNotAcceptable, "Not Acceptable")
-	})
-
-	http.Handle("/metrics", promhttp.Handler())
-
+	server := xserver.New("proxy", address, xproxy.ListenerMiddleware(xproxy.PublicListener, mux), config)
 	log.Printf("Proxy started on %s", address)
-	log.Fatal(http.ListenAndServe(address, nil))
+	log.Fatal(server.ListenAndServe())
 }
@@ -4,17 +4,36 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stefanprodan/xmicro/xconsul"
+	"github.com/stefanprodan/xmicro/xproxy"
+	"github.com/stefanprodan/xmicro/xserver"
+	"github.com/stefanprodan/xmicro/xtoken"
 )
 
 const electionContextKey = "election"
+const identityContextKey = "identity"
 
-// StartAPI starts the HTTP API server
-func StartAPI(address string, election *xconsul.Election) {
+// identityVerifier holds the keyring, the trusted issuer and the audience of the identity tokens injected by the proxy,
+// the audience is the service name the instance is registered as
+type identityVerifier struct {
+	keyring  *xtoken.Keyring
+	issuer   string
+	audience string
+	required bool
+}
+
+// StartAPI starts the HTTP API server on a go routine and returns it, the election endpoints require the admin token
+func StartAPI(address string, election *xconsul.Election, identity *identityVerifier, leader *leaderPolicy, adminToken string, cooldown time.Duration, config xserver.Config) *xserver.Server {
+
+	xserver.RegisterMetrics()
 
-	electionStatusHandler := HeadersMiddleware(ElectionMiddleware(election, http.HandlerFunc(statusResponse)))
+	electionStatusHandler := HeadersMiddleware(FencingMiddleware(election, IdentityMiddleware(identity, ElectionMiddleware(election, LeaderMiddleware(leader, http.HandlerFunc(statusResponse))))))
 	pingHandler := HeadersMiddleware(http.HandlerFunc(pingResponse))
 	healthHandler := HeadersMiddleware(http.HandlerFunc(healthResponse))
 	errorHandler := HeadersMiddleware(http.HandlerFunc(errorResponse))
@@ -24,8 +43,51 @@ func StartAPI(address string, election *xconsul.Election) {
 	mux.Handle("/ping", pingHandler)
 	mux.Handle("/health", healthHandler)
 	mux.Handle("/error", errorHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/election/stepdown", AdminTokenMiddleware(adminToken, stepDownHandler(election, cooldown)))
+
+	server := xserver.New("api", address, mux, config)
 	log.Printf("API started on %s", address)
-	log.Fatal(http.ListenAndServe(address, mux))
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return server
+}
+
+// stepDownHandler releases the leadership, the cooldown query param overrides the default cooldown
+// and the standby param names the instance the leadership is handed to
+func stepDownHandler(election *xconsul.Election, defaultCooldown time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !requireMethod(w, req, http.MethodPost) {
+			return
+		}
+		cooldown := defaultCooldown
+		if value := req.URL.Query().Get("cooldown"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				appCtx.Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid cooldown " + value})
+				return
+			}
+			cooldown = d
+		}
+		standby := req.URL.Query().Get("standby")
+		if err := election.StepDown(cooldown, standby); err != nil {
+			status := http.StatusBadGateway
+			if err == xconsul.ErrNotLeader {
+				status = http.StatusConflict
+			}
+			appCtx.Render.JSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Infof("Stepped down for %v, standby %s", cooldown, standby)
+		appCtx.Render.JSON(w, http.StatusOK, map[string]string{
+			"hostname": appCtx.Hostname,
+			"cooldown": cooldown.String(),
+			"standby":  standby,
+		})
+	}
 }
 
 // ElectionMiddleware injects the election pointer
@@ -36,6 +98,70 @@ func ElectionMiddleware(election *xconsul.Election, next http.Handler) http.Hand
 	})
 }
 
+// FencingMiddleware rejects with 409 the requests carrying a fencing token other than the token of the
+// current leadership, a non-leader rejects every fenced request. The token is not authenticated, so a
+// mismatch never makes the leader step down, the election watch notices a lost lock on its own.
+// Requests without a token are passed through.
+func FencingMiddleware(election *xconsul.Election, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(xconsul.FencingTokenHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		own := election.FencingToken()
+		if token != own {
+			if own == 0 {
+				log.Warnf("Fencing token %v rejected, not the leader", token)
+			} else {
+				log.Warnf("Fencing token %v rejected, current token %v", token, own)
+			}
+			w.Header().Set(xconsul.FencingTokenHeader, strconv.FormatUint(own, 10))
+			http.Error(w, "Conflict: fencing token mismatch", http.StatusConflict)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdentityMiddleware verifies the identity token signed by the proxy and injects its claims.
+// Requests with an invalid token, a token issued for another service, or without one when required, are rejected with 401.
+func IdentityMiddleware(identity *identityVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(xproxy.IdentityTokenHeader)
+		if token == "" {
+			if identity.required {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := xtoken.Verify(token, identity.keyring, xtoken.IdentityToken, identity.audience)
+		if err == nil && claims.Service != identity.issuer {
+			err = fmt.Errorf("untrusted issuer %s", claims.Service)
+		}
+		if err != nil {
+			log.Debugf("Identity token rejected %s", err.Error())
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIdentity returns the verified identity claims, nil if the request has none
+func requestIdentity(r *http.Request) *xtoken.Claims {
+	claims, _ := r.Context().Value(identityContextKey).(*xtoken.Claims)
+	return claims
+}
+
 // HeadersMiddleware injects server headers
 func HeadersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -66,5 +192,13 @@ func statusResponse(w http.ResponseWriter, r *http.Request) {
 	} else {
 		status = fmt.Sprintf("Acting as leader %v", election.IsLeader())
 	}
-	appCtx.Render.JSON(w, http.StatusOK, map[string]string{"status": status, "hostname": appCtx.Hostname, "leader": leader})
+	response := map[string]string{"status": status, "hostname": appCtx.Hostname, "leader": leader}
+	if election.Slots() > 1 {
+		response["leaders"] = strings.Join(election.GetLeaders(), ",")
+	}
+	if identity := requestIdentity(r); identity != nil {
+		response["caller"] = identity.Caller
+		response["client"] = identity.Subject
+	}
+	appCtx.Render.JSON(w, http.StatusOK, response)
 }
@@ -17,19 +17,22 @@ fi
 hostIP="$(hostname -I|awk '{print $1}')"
 
 # start proxy
-docker run -d -p 8000:8000 \
+docker run -d -p 8000:8000 -p 8081:8081 \
 -h "${image}-proxy" \
 --name "${image}-proxy" \
 --network "$network" \
 --restart unless-stopped \
 -e CONSUL_HTTP_ADDR="${hostIP}:8500" \
--e SERVICE_NAME="${image}-proxy" \
+-e SERVICE_8000_NAME="${image}-proxy" \
+-e SERVICE_8081_IGNORE="true" \
 -e SERVICE_TAGS="xmicro,proxy" \
--e SERVICE_CHECK_HTTP="/ping" \
+-e SERVICE_CHECK_TCP="true" \
 -e SERVICE_CHECK_INTERVAL="15s" \
 $image \
 xmicro -env=DEBUG \
 -port=8000 \
+-adminPort=8081 \
+-adminToken="$ADMIN_TOKEN" \
 -role=proxy 
 
 # start frontend
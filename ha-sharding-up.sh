@@ -19,20 +19,23 @@ hostIP="$(hostname -I|awk '{print $1}')"
 # proxy
 node="${image}-proxy"
 role="proxy"
-docker run -d -p 8000:8000 \
+docker run -d -p 8000:8000 -p 8081:8081 \
 -h "$node" \
 --name "$node" \
 --network "$network" \
 --restart unless-stopped \
 --ulimit nofile=65536:65536 \
 -e CONSUL_HTTP_ADDR="${hostIP}:8500" \
--e SERVICE_NAME="$node" \
+-e SERVICE_8000_NAME="$node" \
+-e SERVICE_8081_IGNORE="true" \
 -e SERVICE_TAGS="$role" \
--e SERVICE_CHECK_HTTP="/ping" \
+-e SERVICE_CHECK_TCP="true" \
 -e SERVICE_CHECK_INTERVAL="15s" \
 $image \
 xmicro -env=DEBUG \
 -port=8000 \
+-adminPort=8081 \
+-adminToken="$ADMIN_TOKEN" \
 -role=$role \
 -loglevel=info \
 -proxyMaxIdleConnsPerHost=10000
@@ -54,7 +57,10 @@ $image \
 xmicro -env=DEBUG \
 -port=8000 \
 -role=$role \
--loglevel=info
+-loglevel=info \
+-adminToken="$ADMIN_TOKEN" \
+-electionStandby="${image}-node1-standby" \
+-electionPriority=10
 
 # shard2 primary
 node="${image}-node2"
@@ -73,7 +79,10 @@ $image \
 xmicro -env=DEBUG \
 -port=8000 \
 -role=$role \
--loglevel=info
+-loglevel=info \
+-adminToken="$ADMIN_TOKEN" \
+-electionStandby="${image}-node2-standby" \
+-electionPriority=10
 
 # shard1 standby
 node="${image}-node1-standby"
@@ -92,7 +101,8 @@ $image \
 xmicro -env=DEBUG \
 -port=8000 \
 -role=$role \
--loglevel=info
+-loglevel=info \
+-adminToken="$ADMIN_TOKEN"
 
 # shard2 standby
 node="${image}-node2-standby"
@@ -111,4 +121,5 @@ $image \
 xmicro -env=DEBUG \
 -port=8000 \
 -role=$role \
--loglevel=info
\ No newline at end of file
+-loglevel=info \
+-adminToken="$ADMIN_TOKEN"
\ No newline at end of file
@@ -0,0 +1,475 @@
+package xconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Instance is a registered service instance with its aggregated health
+type Instance struct {
+	ID         string                `json:"id"`
+	Service    string                `json:"service"`
+	Address    string                `json:"address"`
+	Port       int                   `json:"port"`
+	Tags       []string              `json:"tags,omitempty"`
+	Meta       map[string]string     `json:"meta,omitempty"`
+	Node       string                `json:"node"`
+	NodeMeta   map[string]string     `json:"node_meta,omitempty"`
+	Datacenter string                `json:"datacenter"`
+	Health     string                `json:"health"`
+	Leader     bool                  `json:"leader"`
+	Checks     []*consul.HealthCheck `json:"-"`
+}
+
+// Endpoint returns the host:port of the instance, IPv6 addresses are bracketed
+func (i Instance) Endpoint() string {
+	return net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+}
+
+// HasTag returns true if the instance is registered with the tag
+func (i Instance) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ElectionRole returns the role the instance runs for when tagged with le and the role name
+func (i Instance) ElectionRole() (string, bool) {
+	if len(i.Tags) >= 2 && i.Tags[0] == "le" {
+		return i.Tags[1], true
+	}
+	return "", false
+}
+
+// Instances is a list of service instances with query helpers
+type Instances []Instance
+
+// WithTag returns the instances registered with the tag
+func (is Instances) WithTag(tag string) Instances {
+	return is.Filter(func(i Instance) bool { return i.HasTag(tag) })
+}
+
+// WithMeta returns the instances with the service meta key set to value, node meta is used as fallback
+func (is Instances) WithMeta(key string, value string) Instances {
+	return is.Filter(func(i Instance) bool {
+		if v, ok := i.Meta[key]; ok {
+			return v == value
+		}
+		return i.NodeMeta[key] == value
+	})
+}
+
+// WithHealth returns the instances in one of the health states
+func (is Instances) WithHealth(states ...string) Instances {
+	return is.Filter(func(i Instance) bool {
+		for _, s := range states {
+			if i.Health == s {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// InDatacenter returns the instances of the datacenter
+func (is Instances) InDatacenter(dc string) Instances {
+	return is.Filter(func(i Instance) bool { return i.Datacenter == dc })
+}
+
+// OnNode returns the instances running on the node
+func (is Instances) OnNode(node string) Instances {
+	return is.Filter(func(i Instance) bool { return i.Node == node })
+}
+
+// Filter returns the instances matching the predicate
+func (is Instances) Filter(match func(Instance) bool) Instances {
+	filtered := make(Instances, 0, len(is))
+	for _, i := range is {
+		if match(i) {
+			filtered = append(filtered, i)
+		}
+	}
+	return filtered
+}
+
+// Leader returns the elected instance
+func (is Instances) Leader() (Instance, bool) {
+	for _, i := range is {
+		if i.Leader {
+			return i, true
+		}
+	}
+	return Instance{}, false
+}
+
+// Endpoints returns the host:port of each instance
+func (is Instances) Endpoints() []string {
+	endpoints := make([]string, 0, len(is))
+	for _, i := range is {
+		endpoints = append(endpoints, i.Endpoint())
+	}
+	return endpoints
+}
+
+// MarkLeaders flags the instances of the service elected for their role
+func (is Instances) MarkLeaders(elections map[string]string) Instances {
+	holders := make(map[string][]string, len(elections))
+	for role, service := range elections {
+		holders[role] = []string{service}
+	}
+	return is.MarkHolders(holders)
+}
+
+// MarkHolders flags the instances of the services holding a slot of their role
+func (is Instances) MarkHolders(holders map[string][]string) Instances {
+	marked := make(Instances, len(is))
+	for n, i := range is {
+		i.Leader = false
+		if role, ok := i.ElectionRole(); ok {
+			for _, service := range holders[role] {
+				if service == i.Service {
+					i.Leader = true
+					break
+				}
+			}
+		}
+		marked[n] = i
+	}
+	return marked
+}
+
+// AggregateHealth returns the worst status of the node and service checks
+func AggregateHealth(checks []*consul.HealthCheck) string {
+	status := consul.HealthPassing
+	for _, check := range checks {
+		switch check.Status {
+		case consul.HealthCritical:
+			return consul.HealthCritical
+		case consul.HealthWarning:
+			status = consul.HealthWarning
+		}
+	}
+	return status
+}
+
+// Catalog queries the Consul catalog and the leader elections
+type Catalog struct {
+	Client            *consul.Client
+	ElectionKeyPrefix string
+	datacenter        string
+	lock              sync.Mutex
+}
+
+// NewCatalog returns a Catalog using the client and the election key prefix
+func NewCatalog(client *consul.Client, electionKeyPrefix string) *Catalog {
+	return &Catalog{
+		Client:            client,
+		ElectionKeyPrefix: electionKeyPrefix,
+	}
+}
+
+// healthEntry is the health endpoint response including the node and service meta,
+// the vendored api client predates them
+type healthEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+		Meta       map[string]string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Tags    []string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+	Checks []*consul.HealthCheck
+}
+
+// Services returns the names of the registered services, set q.Datacenter to query another datacenter
+func (c *Catalog) Services(q *consul.QueryOptions) ([]string, error) {
+	services, _, err := c.Client.Catalog().Services(q)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	return names, nil
+}
+
+// Service returns the instances of a service, set q.WaitIndex for a blocking query.
+// Instances without a service address use the node address.
+func (c *Catalog) Service(service string, q *consul.QueryOptions) (Instances, *consul.QueryMeta, error) {
+	var entries []healthEntry
+	meta, err := c.Client.Raw().Query("/v1/health/service/"+url.PathEscape(service), &entries, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	instances := make(Instances, 0, len(entries))
+	for _, e := range entries {
+		address := e.Service.Address
+		if address == "" {
+			address = e.Node.Address
+		}
+		dc := e.Node.Datacenter
+		if dc == "" && q != nil {
+			dc = q.Datacenter
+		}
+		if dc == "" {
+			dc = c.Datacenter()
+		}
+		instances = append(instances, Instance{
+			ID:         e.Service.ID,
+			Service:    e.Service.Service,
+			Address:    strings.Trim(address, "[]"),
+			Port:       e.Service.Port,
+			Tags:       e.Service.Tags,
+			Meta:       e.Service.Meta,
+			Node:       e.Node.Node,
+			NodeMeta:   e.Node.Meta,
+			Datacenter: dc,
+			Health:     AggregateHealth(e.Checks),
+			Checks:     e.Checks,
+		})
+	}
+	return instances, meta, nil
+}
+
+// Instances returns the instances of all services with the elected ones flagged
+func (c *Catalog) Instances() (map[string]Instances, error) {
+	services, err := c.Services(nil)
+	if err != nil {
+		return nil, err
+	}
+	holders, err := c.Holders(nil)
+	if err != nil {
+		return nil, err
+	}
+	catalog := make(map[string]Instances, len(services))
+	for _, service := range services {
+		instances, _, err := c.Service(service, nil)
+		if err != nil {
+			return nil, err
+		}
+		catalog[service] = instances.MarkHolders(holders)
+	}
+	return catalog, nil
+}
+
+// Elections returns the elected service of each role, none if the election key prefix is not set.
+// Set q.Datacenter to read the elections of another datacenter.
+func (c *Catalog) Elections(q *consul.QueryOptions) (map[string]string, error) {
+	holders, err := c.Holders(q)
+	if err != nil {
+		return nil, err
+	}
+	return leaders(holders), nil
+}
+
+// Holders returns the services holding a slot of each role, none if the election key prefix is not set.
+// Set q.Datacenter to read the elections of another datacenter.
+func (c *Catalog) Holders(q *consul.QueryOptions) (map[string][]string, error) {
+	pairs, err := c.ElectionPairs(q)
+	if err != nil {
+		return nil, err
+	}
+	return c.ElectedHolders(pairs, q)
+}
+
+// ElectionPairs returns the KV pairs under the election key prefix, none if the prefix is not set
+func (c *Catalog) ElectionPairs(q *consul.QueryOptions) (consul.KVPairs, error) {
+	if c.ElectionKeyPrefix == "" {
+		return consul.KVPairs{}, nil
+	}
+	pairs, _, err := c.Client.KV().List(c.ElectionKeyPrefix, q)
+	return pairs, err
+}
+
+// ElectedServices returns the elected service of each role from the election KV pairs,
+// the first slot holder by name for the roles elected with a semaphore
+func (c *Catalog) ElectedServices(pairs consul.KVPairs, q *consul.QueryOptions) (map[string]string, error) {
+	holders, err := c.ElectedHolders(pairs, q)
+	if err != nil {
+		return nil, err
+	}
+	return leaders(holders), nil
+}
+
+// ElectedHolders returns the services holding a slot of each role from the election KV pairs,
+// sorted by name. A role key locked by a session has one holder, the name of the session.
+// A role prefix used as a semaphore has up to its limit holders, the live sessions listed in its lock key.
+// Sessions are local to a datacenter, q.Datacenter must match the datacenter of the pairs.
+func (c *Catalog) ElectedHolders(pairs consul.KVPairs, q *consul.QueryOptions) (map[string][]string, error) {
+	sessions := make(map[string][]string)
+	locks := make(map[string]*consul.KVPair)
+	alive := make(map[string]map[string]bool)
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, c.ElectionKeyPrefix)
+		role, entry := key, ""
+		if n := strings.Index(key, "/"); n >= 0 {
+			role, entry = key[:n], key[n+1:]
+		}
+		switch {
+		case entry == "":
+			if pair.Session != "" {
+				sessions[role] = []string{pair.Session}
+			}
+		case pair.Flags != consul.SemaphoreFlagValue:
+		case entry == consul.DefaultSemaphoreKey:
+			locks[role] = pair
+		case pair.Session != "":
+			if alive[role] == nil {
+				alive[role] = make(map[string]bool)
+			}
+			alive[role][pair.Session] = true
+		}
+	}
+	for role, pair := range locks {
+		var lock struct {
+			Limit   int
+			Holders map[string]bool
+		}
+		if err := json.Unmarshal(pair.Value, &lock); err != nil {
+			return nil, fmt.Errorf("invalid semaphore %s %s", pair.Key, err.Error())
+		}
+		for session := range lock.Holders {
+			// holders are pruned on the next acquire, skip the ones whose session is gone
+			if alive[role][session] {
+				sessions[role] = append(sessions[role], session)
+			}
+		}
+	}
+
+	holders := make(map[string][]string)
+	names := make(map[string]string)
+	for role, ids := range sessions {
+		for _, id := range ids {
+			name, err := c.sessionName(id, q, names)
+			if err != nil {
+				return nil, err
+			}
+			if name != "" {
+				holders[role] = append(holders[role], name)
+			}
+		}
+		sort.Strings(holders[role])
+	}
+	return holders, nil
+}
+
+// FencingTokens returns the fencing token of each holder of the elected roles from the election KV pairs,
+// by role and holder name. The token of a role key locked by a session is the modify index of the key,
+// the token of a semaphore slot holder is the modify index of its contender key, both grow with every acquisition.
+// Sessions are local to a datacenter, q.Datacenter must match the datacenter of the pairs.
+func (c *Catalog) FencingTokens(pairs consul.KVPairs, q *consul.QueryOptions) (map[string]map[string]uint64, error) {
+	tokens := make(map[string]map[string]uint64)
+	names := make(map[string]string)
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, c.ElectionKeyPrefix)
+		role, entry := key, ""
+		if n := strings.Index(key, "/"); n >= 0 {
+			role, entry = key[:n], key[n+1:]
+		}
+		// only the role key and the semaphore contender keys are held by a holder session
+		if pair.Session == "" || entry != "" && (pair.Flags != consul.SemaphoreFlagValue || entry == consul.DefaultSemaphoreKey) {
+			continue
+		}
+		name, err := c.sessionName(pair.Session, q, names)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		if tokens[role] == nil {
+			tokens[role] = make(map[string]uint64)
+		}
+		if pair.ModifyIndex > tokens[role][name] {
+			tokens[role][name] = pair.ModifyIndex
+		}
+	}
+	return tokens, nil
+}
+
+// sessionName returns the name of the session, empty if the session is gone. Names are cached in names.
+func (c *Catalog) sessionName(id string, q *consul.QueryOptions, names map[string]string) (string, error) {
+	if name, ok := names[id]; ok {
+		return name, nil
+	}
+	sessionInfo, _, err := c.Client.Session().Info(id, q)
+	if err != nil {
+		return "", err
+	}
+	name := ""
+	if sessionInfo != nil {
+		name = sessionInfo.Name
+	}
+	names[id] = name
+	return name, nil
+}
+
+// leaders returns the first holder of each role
+func leaders(holders map[string][]string) map[string]string {
+	elections := make(map[string]string, len(holders))
+	for role, services := range holders {
+		if len(services) > 0 {
+			elections[role] = services[0]
+		}
+	}
+	return elections
+}
+
+// Datacenters returns the known datacenters sorted by round trip time from the local agent
+func (c *Catalog) Datacenters() ([]string, error) {
+	return c.Client.Catalog().Datacenters()
+}
+
+// Datacenter returns the datacenter of the local agent, empty if the agent can't be reached
+func (c *Catalog) Datacenter() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.datacenter != "" {
+		return c.datacenter
+	}
+	self, err := c.Client.Agent().Self()
+	if err != nil {
+		return ""
+	}
+	if dc, ok := self["Config"]["Datacenter"].(string); ok {
+		c.datacenter = dc
+	}
+	return c.datacenter
+}
+
+// Node returns the name and the node meta of the local agent node
+func (c *Catalog) Node() (string, map[string]string, error) {
+	self, err := c.Client.Agent().Self()
+	if err != nil {
+		return "", nil, err
+	}
+	name, _ := self["Config"]["NodeName"].(string)
+	var node struct {
+		Node struct {
+			Meta map[string]string
+		}
+	}
+	if _, err := c.Client.Raw().Query("/v1/catalog/node/"+url.PathEscape(name), &node, nil); err != nil {
+		return name, nil, err
+	}
+	return name, node.Node.Meta, nil
+}
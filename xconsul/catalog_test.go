@@ -0,0 +1,180 @@
+package xconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const testElectionPrefix = "xmicro/election/"
+
+// testClient returns a client of a fake Consul agent answering each path with its response as JSON,
+// an empty list if the path is not set
+func testClient(t *testing.T, responses map[string]interface{}) *consul.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			response = []interface{}{}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	config := consul.DefaultConfig()
+	config.Address = strings.TrimPrefix(server.URL, "http://")
+	client, err := consul.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// testCatalog returns a Catalog backed by a fake Consul agent serving the session names by id
+func testCatalog(t *testing.T, sessions map[string]string) *Catalog {
+	t.Helper()
+	responses := make(map[string]interface{}, len(sessions))
+	for id, name := range sessions {
+		responses["/v1/session/info/"+id] = []*consul.SessionEntry{{Name: name}}
+	}
+	return NewCatalog(testClient(t, responses), testElectionPrefix)
+}
+
+// lockPair is a role key locked by a session
+func lockPair(role string, session string, index uint64) *consul.KVPair {
+	return &consul.KVPair{Key: testElectionPrefix + role, Value: []byte(role), Session: session, ModifyIndex: index}
+}
+
+// semaphorePairs are the lock key and the contender keys of a role elected with a semaphore
+func semaphorePairs(t *testing.T, role string, limit int, holders []string, contenders map[string]uint64) consul.KVPairs {
+	t.Helper()
+	lock := struct {
+		Limit   int
+		Holders map[string]bool
+	}{limit, make(map[string]bool)}
+	for _, session := range holders {
+		lock.Holders[session] = true
+	}
+	value, err := json.Marshal(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := consul.KVPairs{{Key: testElectionPrefix + role + "/" + consul.DefaultSemaphoreKey, Value: value, Flags: consul.SemaphoreFlagValue}}
+	for session, index := range contenders {
+		pairs = append(pairs, &consul.KVPair{
+			Key:         testElectionPrefix + role + "/" + session,
+			Session:     session,
+			Flags:       consul.SemaphoreFlagValue,
+			ModifyIndex: index,
+		})
+	}
+	return pairs
+}
+
+func TestCatalogElectedHolders(t *testing.T) {
+	catalog := testCatalog(t, map[string]string{
+		"s-storage":   "xmicro-storage",
+		"s-backend-1": "xmicro-backend-1",
+		"s-backend-2": "xmicro-backend-2",
+		"s-backend-3": "xmicro-backend-3",
+	})
+	tests := []struct {
+		name     string
+		pairs    consul.KVPairs
+		expected map[string][]string
+	}{
+		{"lock", consul.KVPairs{lockPair("storage", "s-storage", 10)}, map[string][]string{"storage": {"xmicro-storage"}}},
+		{"lock released", consul.KVPairs{lockPair("storage", "", 10)}, map[string][]string{}},
+		{"lock session gone", consul.KVPairs{lockPair("storage", "s-expired", 10)}, map[string][]string{}},
+		{"semaphore", semaphorePairs(t, "backend", 2, []string{"s-backend-2", "s-backend-1"},
+			map[string]uint64{"s-backend-1": 11, "s-backend-2": 12, "s-backend-3": 13}),
+			map[string][]string{"backend": {"xmicro-backend-1", "xmicro-backend-2"}}},
+		{"semaphore holder without contender key", semaphorePairs(t, "backend", 2, []string{"s-backend-1", "s-backend-2"},
+			map[string]uint64{"s-backend-1": 11}),
+			map[string][]string{"backend": {"xmicro-backend-1"}}},
+		{"semaphore holder session gone", semaphorePairs(t, "backend", 2, []string{"s-backend-1", "s-expired"},
+			map[string]uint64{"s-backend-1": 11, "s-expired": 12}),
+			map[string][]string{"backend": {"xmicro-backend-1"}}},
+		{"lock and semaphore", append(consul.KVPairs{lockPair("storage", "s-storage", 10)},
+			semaphorePairs(t, "backend", 1, []string{"s-backend-3"}, map[string]uint64{"s-backend-3": 13})...),
+			map[string][]string{"storage": {"xmicro-storage"}, "backend": {"xmicro-backend-3"}}},
+		{"other keys", consul.KVPairs{
+			{Key: testElectionPrefix + "storage/transfer", Value: []byte("xmicro-storage"), Session: "s-storage"},
+			{Key: testElectionPrefix + "storage/candidates/xmicro-storage", Value: []byte("1")},
+		}, map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holders, err := catalog.ElectedHolders(tt.pairs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(holders, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, holders)
+			}
+		})
+	}
+}
+
+func TestCatalogElectedHoldersInvalidSemaphore(t *testing.T) {
+	catalog := testCatalog(t, nil)
+	pairs := consul.KVPairs{{Key: testElectionPrefix + "backend/" + consul.DefaultSemaphoreKey, Value: []byte("{"), Flags: consul.SemaphoreFlagValue}}
+	if _, err := catalog.ElectedHolders(pairs, nil); err == nil {
+		t.Fatal("expected an error for the invalid semaphore lock")
+	}
+}
+
+func TestCatalogElectedServices(t *testing.T) {
+	catalog := testCatalog(t, map[string]string{"s-backend-1": "xmicro-backend-1", "s-backend-2": "xmicro-backend-2"})
+	pairs := semaphorePairs(t, "backend", 2, []string{"s-backend-2", "s-backend-1"},
+		map[string]uint64{"s-backend-1": 11, "s-backend-2": 12})
+	elections, err := catalog.ElectedServices(pairs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elections["backend"] != "xmicro-backend-1" {
+		t.Fatalf("expected the first holder by name, got %v", elections)
+	}
+}
+
+func TestCatalogFencingTokens(t *testing.T) {
+	catalog := testCatalog(t, map[string]string{
+		"s-storage":   "xmicro-storage",
+		"s-backend-1": "xmicro-backend-1",
+		"s-backend-2": "xmicro-backend-2",
+	})
+	tests := []struct {
+		name     string
+		pairs    consul.KVPairs
+		expected map[string]map[string]uint64
+	}{
+		{"lock", consul.KVPairs{lockPair("storage", "s-storage", 10)}, map[string]map[string]uint64{"storage": {"xmicro-storage": 10}}},
+		{"lock released", consul.KVPairs{lockPair("storage", "", 10)}, map[string]map[string]uint64{}},
+		{"lock session gone", consul.KVPairs{lockPair("storage", "s-expired", 10)}, map[string]map[string]uint64{}},
+		{"semaphore", semaphorePairs(t, "backend", 2, []string{"s-backend-1", "s-backend-2"},
+			map[string]uint64{"s-backend-1": 11, "s-backend-2": 12}),
+			map[string]map[string]uint64{"backend": {"xmicro-backend-1": 11, "xmicro-backend-2": 12}}},
+		{"lock and semaphore", append(consul.KVPairs{lockPair("storage", "s-storage", 10)},
+			semaphorePairs(t, "backend", 1, []string{"s-backend-1"}, map[string]uint64{"s-backend-1": 11})...),
+			map[string]map[string]uint64{"storage": {"xmicro-storage": 10}, "backend": {"xmicro-backend-1": 11}}},
+		{"other keys", consul.KVPairs{
+			{Key: testElectionPrefix + "storage/transfer", Value: []byte("xmicro-storage"), Session: "s-storage", ModifyIndex: 20},
+			{Key: testElectionPrefix + "backend/" + consul.DefaultSemaphoreKey, Session: "s-backend-1", Flags: consul.SemaphoreFlagValue, ModifyIndex: 21},
+		}, map[string]map[string]uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := catalog.FencingTokens(tt.pairs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tokens, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, tokens)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package xconsul
 
 import (
 	"encoding/json"
-	"fmt"
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
@@ -55,61 +54,28 @@ func (c *ConsulClient) ListServices() error {
 
 // GetServices returns a map of services and endpoints
 func (c *ConsulClient) GetServices() (map[string][]string, error) {
-
 	registry := make(map[string][]string)
-
-	services, _, err := c.Client.Catalog().Services(nil)
+	instances, err := NewCatalog(c.Client, "").Instances()
 	if err != nil {
 		return registry, err
 	}
-	for service := range services {
-		r, _, err := c.Client.Health().Service(service, "", false, nil)
-		if err != nil {
-			return registry, err
-		}
-
-		for _, s := range r {
-			registry[service] = append(registry[service], fmt.Sprintf("%s:%v", s.Service.Address, s.Service.Port))
-		}
+	for service, i := range instances {
+		registry[service] = i.Endpoints()
 	}
 	return registry, nil
 }
 
-// GetLeaderServices returns a map of elected leaders and their endpoints
+// GetLeaderServices returns a map of roles and the endpoints of their elected leaders or slot holders
 func (c *ConsulClient) GetLeaderServices(electionKeyPrefix string) (map[string][]string, error) {
-
 	registry := make(map[string][]string)
-
-	services, _, err := c.Client.Catalog().Services(nil)
+	instances, err := NewCatalog(c.Client, electionKeyPrefix).Instances()
 	if err != nil {
 		return registry, err
 	}
-	for service := range services {
-		r, _, err := c.Client.Health().Service(service, "", false, nil)
-		if err != nil {
-			return registry, err
-		}
-
-		for _, s := range r {
-			//detect if service is subject to leader election
-			if len(s.Service.Tags) == 2 && s.Service.Tags[0] == "le" {
-				var electionKey = electionKeyPrefix + s.Service.Tags[1]
-				kvpair, _, err := c.Client.KV().Get(electionKey, nil)
-				if kvpair != nil && err == nil {
-					//check if a session is locking the key
-					sessionInfo, _, err := c.Client.Session().Info(kvpair.Session, nil)
-					if err == nil && sessionInfo != nil {
-						//extract leader name from session name and validate
-						_, present := registry[s.Service.Tags[1]]
-						if !present && service == sessionInfo.Name {
-							//add service to registry using the tag as service name
-							registry[s.Service.Tags[1]] = append(registry[s.Service.Tags[1]], fmt.Sprintf("%s:%v", s.Service.Address, s.Service.Port))
-						}
-					} else {
-						return registry, err
-					}
-				}
-			}
+	for _, i := range instances {
+		if leader, ok := i.Leader(); ok {
+			role, _ := leader.ElectionRole()
+			registry[role] = append(registry[role], leader.Endpoint())
 		}
 	}
 	return registry, nil
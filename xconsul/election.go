@@ -1,103 +1,557 @@
 package xconsul
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
 )
 
-// Election holds the Consul leader election lock, config and status
+// FencingTokenHeader carries the fencing token of the elected leader a request is routed to
+const FencingTokenHeader = "X-Fencing-Token"
+
+// LeaderHopHeader marks a request forwarded to the leader by another instance of the role,
+// a forwarded request is never forwarded again. Proxies remove it from client requests.
+const LeaderHopHeader = "X-Leader-Hop"
+
+// ErrNotLeader is returned when stepping down an instance that is not leading
+var ErrNotLeader = errors.New("not the leader")
+
+// ErrNoLeader is returned when the role has no elected leader
+var ErrNoLeader = errors.New("no leader elected")
+
+// transferKey holds the standby a leader stepped down for, under the election key prefix
+const transferKey = ".transfer/"
+
+// transfer is the handover of a role to a standby, the other candidates yield until it expires
+type transfer struct {
+	Standby string    `json:"standby"`
+	Until   time.Time `json:"until"`
+}
+
+// stepDown is a request to release the leadership and stay out of the election for the cooldown
+type stepDown struct {
+	cooldown time.Duration
+	done     chan struct{}
+}
+
+// Transition is a change of the leadership state of the instance, Token is the fencing token when elected
+type Transition struct {
+	Leader bool      `json:"leader"`
+	Token  uint64    `json:"token,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Election holds the Consul leader election lock, or the semaphore when up to slots instances lead, config and status
 type Election struct {
-	electionKey string
-	isLeader    bool
-	consulLock  *consul.Lock
-	stopChan    chan struct{}
-	lockChan    chan struct{}
+	// token is first to keep it 64-bit aligned for atomic access
+	token         uint64
+	electionKey   string
+	keyPrefix     string
+	name          string
+	role          string
+	slots         int
+	priority      int
+	hysteresis    time.Duration
+	candidacy     string
+	timings       Timings
+	leaders       []string
+	watched       bool
+	isLeader      int32
+	client        *consul.Client
+	consulLock    *consul.Lock
+	semaphore     *consul.Semaphore
+	onElected     []func(context.Context)
+	onDemoted     []func()
+	stepDowns     chan stepDown
+	transitions   chan Transition
+	leaderChanges chan LeaderChange
+	cancel        context.CancelFunc
+	done          chan struct{}
+	lock          sync.Mutex
+}
+
+// NewElection returns an election for the role, the lock is held by up to slots instances using a semaphore
+// when slots is greater than 1. The session is named after the service. The election starts with Run.
+func NewElection(serviceName string, keyPrefix string, role string, slots int) (*Election, error) {
+	key := keyPrefix + role
+	client, err := consul.NewClient(consul.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	election := &Election{
+		electionKey: key,
+		keyPrefix:   keyPrefix,
+		name:        serviceName,
+		role:        role,
+		slots:       slots,
+		hysteresis:  30 * time.Second,
+		timings:     DefaultTimings(),
+		client:      client,
+		stepDowns:   make(chan stepDown, 1),
+	}
+	if slots > 1 {
+		election.semaphore, err = client.SemaphoreOpts(&consul.SemaphoreOptions{
+			Prefix:      key,
+			Limit:       slots,
+			Value:       []byte(serviceName),
+			SessionName: serviceName,
+			SessionTTL:  "10s",
+		})
+	} else {
+		election.consulLock, err = client.LockOpts(&consul.LockOptions{
+			Key: key,
+			SessionOpts: &consul.SessionEntry{
+				Name:      serviceName,
+				LockDelay: time.Duration(5 * time.Second),
+				TTL:       "10s",
+			},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return election, nil
+}
+
+// OnElected registers a callback run on its own go routine every time the instance is elected,
+// ctx is cancelled as soon as the leadership is lost or the election stops
+func (e *Election) OnElected(fn func(ctx context.Context)) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.onElected = append(e.onElected, fn)
+}
+
+// OnDemoted registers a callback run every time the instance loses the leadership, after the lock is released
+func (e *Election) OnDemoted(fn func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.onDemoted = append(e.onDemoted, fn)
+}
+
+// Transitions returns the leadership state changes, transitions are only published once Transitions
+// has been called and are dropped if the channel is not drained
+func (e *Election) Transitions() <-chan Transition {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.transitions == nil {
+		e.transitions = make(chan Transition, 16)
+	}
+	return e.transitions
+}
+
+// Run takes part in the election until ctx is cancelled or Stop is called, the lock is released before returning
+func (e *Election) Run(ctx context.Context) error {
+	ctx, done, err := e.register(ctx)
+	if err != nil {
+		return err
+	}
+	e.run(ctx, done)
+	return nil
 }
 
-func (e *Election) start() {
-	stop := false
-	for !stop {
+// register marks the election as running, Stop cancels the returned ctx and waits for done
+func (e *Election) register(ctx context.Context) (context.Context, chan struct{}, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.done != nil {
+		return nil, nil, errors.New("election is already running")
+	}
+	ctx, e.cancel = context.WithCancel(ctx)
+	e.done = make(chan struct{})
+	return ctx, e.done, nil
+}
+
+// run loops over the election rounds until ctx is cancelled
+func (e *Election) run(ctx context.Context, done chan struct{}) {
+	defer func() {
+		e.lock.Lock()
+		e.cancel()
+		e.cancel = nil
+		e.done = nil
+		e.watched = false
+		e.lock.Unlock()
+		close(done)
+	}()
+	go e.watchLeaders(ctx)
+	// every instance advertises its candidacy, a leader only transfers the role to a running candidate
+	go e.advertise(ctx)
+
+	failures := 0
+	for ctx.Err() == nil {
+		leaders := e.GetLeaders()
+		if len(leaders) > 0 && e.semaphore != nil {
+			log.Infof("Slot holders are %v of %v", leaders, e.slots)
+		} else if len(leaders) > 0 {
+			log.Infof("Leader is %s", leaders[0])
+		} else {
+			log.Info("No leader found, starting election...")
+		}
+		electionChan, err := e.acquire(ctx.Done())
+		if err != nil {
+			log.Warnf("Failed to acquire election lock %s", err.Error())
+		}
+		if electionChan == nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failures++
+			wait := e.timings.backoff(failures)
+			log.Infof("Retrying election in %v", wait)
+			e.sleep(ctx, wait)
+			continue
+		}
+		failures = 0
+		if standby, wait := e.transferPending(); wait > 0 {
+			log.Infof("Yielding leadership to %s for %v", standby, wait.Round(time.Second))
+			e.release()
+			e.sleep(ctx, wait)
+			continue
+		}
+		if preferred := e.preferredCandidate(); preferred != "" {
+			log.Infof("Yielding leadership to %s, it has a higher priority", preferred)
+			if err := e.handover(preferred, e.hysteresis); err != nil {
+				log.Warnf("Failed to hand leadership to %s %s", preferred, err.Error())
+			}
+			e.deferCandidacy(e.hysteresis)
+			e.release()
+			e.sleep(ctx, e.hysteresis)
+			continue
+		}
+		if cooldown := e.lead(ctx, electionChan); cooldown > 0 {
+			log.Infof("Stepped down, rejoining the election in %v", cooldown)
+			e.sleep(ctx, cooldown)
+		}
+	}
+}
+
+// sleep waits for the duration or until ctx is cancelled
+func (e *Election) sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// lead runs the elected callbacks and blocks until the leadership is lost, ctx is cancelled or the
+// instance steps down, it returns the cooldown of the step down
+func (e *Election) lead(ctx context.Context, electionChan <-chan struct{}) time.Duration {
+	log.Info("Acting as elected leader.")
+	// a step down requested after the previous term ended is done already
+	select {
+	case s := <-e.stepDowns:
+		close(s.done)
+	default:
+	}
+	leaderCtx, cancel := context.WithCancel(ctx)
+	e.fence()
+	atomic.StoreInt32(&e.isLeader, 1)
+	e.transition(true)
+	e.lock.Lock()
+	onElected := append([]func(context.Context){}, e.onElected...)
+	e.lock.Unlock()
+	for _, fn := range onElected {
+		go fn(leaderCtx)
+	}
+	go e.watchPriorities(leaderCtx)
+
+	var step *stepDown
+	select {
+	case <-electionChan:
+		log.Warn("Leadership lost, releasing lock.")
+	case <-ctx.Done():
+		log.Info("Election stopped, releasing lock.")
+	case s := <-e.stepDowns:
+		log.Info("Stepping down, releasing lock.")
+		step = &s
+		// stay out of the preferred candidates before another instance is elected
+		e.deferCandidacy(s.cooldown)
+	}
+	cancel()
+	atomic.StoreInt32(&e.isLeader, 0)
+	atomic.StoreUint64(&e.token, 0)
+	e.release()
+	e.transition(false)
+	e.lock.Lock()
+	onDemoted := append([]func(){}, e.onDemoted...)
+	e.lock.Unlock()
+	for _, fn := range onDemoted {
+		fn()
+	}
+	if step == nil {
 		select {
-		case <-e.stopChan:
-			stop = true
+		case s := <-e.stepDowns:
+			step = &s
 		default:
-			leader := e.GetLeader()
-			if leader != "" {
-				log.Info("Leader is %s", leader)
-			} else {
-				log.Info("No leader found, starting election...")
-			}
-			electionChan, err := e.consulLock.Lock(e.lockChan)
+			return 0
+		}
+	}
+	close(step.done)
+	return step.cooldown
+}
+
+// StepDown releases the leadership and keeps the instance out of the election for the cooldown.
+// If standby is set, the other candidates yield the role to the standby until the cooldown ends.
+// A standby that holds no candidate key or fails its health checks is not ready, the role is then left
+// to an open election.
+// It returns once the lock is released, ErrNotLeader if the instance is not leading.
+func (e *Election) StepDown(cooldown time.Duration, standby string) error {
+	e.lock.Lock()
+	running := e.done
+	e.lock.Unlock()
+	if running == nil || !e.IsLeader() {
+		return ErrNotLeader
+	}
+	if standby != "" {
+		if ok, err := e.isReady(standby); !ok {
 			if err != nil {
-				log.Warnf("Failed to acquire election lock %s", err.Error())
+				log.Warnf("Failed to read the readiness of standby %s %s", standby, err.Error())
 			}
-			if electionChan != nil {
-				log.Info("Acting as elected leader.")
-				e.isLeader = true
-				<-electionChan
-				e.isLeader = false
-				log.Warn("Leadership lost, releasing lock.")
-				e.consulLock.Unlock()
-			} else {
-				log.Info("Retrying election in 5s")
-				time.Sleep(5000 * time.Millisecond)
+			log.Warnf("Standby %s is not a healthy candidate, leaving the leadership to an open election", standby)
+			standby = ""
+		}
+	}
+	if standby != "" {
+		if err := e.handover(standby, cooldown); err != nil {
+			return err
+		}
+		log.Infof("Transferring leadership to %s", standby)
+	}
+	step := stepDown{cooldown: cooldown, done: make(chan struct{})}
+	select {
+	case e.stepDowns <- step:
+	default:
+		return errors.New("step down in progress")
+	}
+	select {
+	case <-step.done:
+	case <-running:
+	}
+	return nil
+}
+
+// handover makes the other candidates yield the role to the standby for the duration
+func (e *Election) handover(standby string, d time.Duration) error {
+	value, _ := json.Marshal(transfer{Standby: standby, Until: time.Now().UTC().Add(d)})
+	_, err := e.client.KV().Put(&consul.KVPair{Key: e.transferKey(), Value: value}, nil)
+	return err
+}
+
+// transferKey returns the key of the role handover
+func (e *Election) transferKey() string {
+	return e.keyPrefix + transferKey + e.role
+}
+
+// transferPending returns the standby and the remaining time of a handover to another instance,
+// the handover is cleared once the standby is elected, is no longer ready or it expired
+func (e *Election) transferPending() (string, time.Duration) {
+	kv := e.client.KV()
+	pair, _, err := kv.Get(e.transferKey(), nil)
+	if err != nil || pair == nil {
+		return "", 0
+	}
+	var t transfer
+	if err := json.Unmarshal(pair.Value, &t); err != nil || t.Standby == e.name || time.Now().After(t.Until) || !e.standbyReady(t.Standby) {
+		kv.DeleteCAS(pair, nil)
+		return "", 0
+	}
+	return t.Standby, t.Until.Sub(time.Now())
+}
+
+// standbyReady returns false if the standby holds no candidate key or is unhealthy, true if either can't be read
+func (e *Election) standbyReady(standby string) bool {
+	ok, err := e.isReady(standby)
+	return ok || err != nil
+}
+
+// transition publishes the state change without blocking, if anyone listens
+func (e *Election) transition(leader bool) {
+	e.lock.Lock()
+	transitions := e.transitions
+	e.lock.Unlock()
+	if transitions == nil {
+		return
+	}
+	select {
+	case transitions <- Transition{Leader: leader, Token: e.FencingToken(), Time: time.Now().UTC()}:
+	default:
+		log.Warn("Election transitions channel is full, dropping transition")
+	}
+}
+
+// fence reads the fencing token of the acquired lock, the modify index of the lock key
+// or of the semaphore contender key of the instance
+func (e *Election) fence() {
+	token, err := e.readToken()
+	if err != nil {
+		log.Warnf("Failed to read fencing token of %s %s", e.electionKey, err.Error())
+		return
+	}
+	atomic.StoreUint64(&e.token, token)
+	log.Infof("Fencing token is %v", token)
+}
+
+// readToken returns the modify index of the lock key, or of the contender key holding a semaphore slot
+// named after the instance, the newest one if a previous session of the instance is still listed
+func (e *Election) readToken() (uint64, error) {
+	q := &consul.QueryOptions{RequireConsistent: true}
+	if e.semaphore == nil {
+		pair, _, err := e.client.KV().Get(e.electionKey, q)
+		if err != nil {
+			return 0, err
+		}
+		if pair == nil {
+			return 0, errors.New("lock key not found")
+		}
+		return pair.ModifyIndex, nil
+	}
+	pairs, _, err := e.client.KV().List(e.electionKey+"/", q)
+	if err != nil {
+		return 0, err
+	}
+	var lock struct {
+		Holders map[string]bool
+	}
+	for _, pair := range pairs {
+		if pair.Key == e.electionKey+"/"+consul.DefaultSemaphoreKey {
+			if err := json.Unmarshal(pair.Value, &lock); err != nil {
+				return 0, err
 			}
 		}
 	}
+	var token uint64
+	for _, pair := range pairs {
+		if pair.Flags == consul.SemaphoreFlagValue && lock.Holders[pair.Session] && string(pair.Value) == e.name && pair.ModifyIndex > token {
+			token = pair.ModifyIndex
+		}
+	}
+	if token == 0 {
+		return 0, errors.New("contender key not found")
+	}
+	return token, nil
 }
 
-// Stop ends the election routine and releases the lock
-func (e *Election) Stop() {
-	e.stopChan <- struct{}{}
-	e.lockChan <- struct{}{}
+// FencingToken returns the fencing token of the current leadership, 0 if not leader or unknown
+func (e *Election) FencingToken() uint64 {
+	return atomic.LoadUint64(&e.token)
+}
+
+// acquire blocks until the lock or a semaphore slot is held, or stop is closed
+func (e *Election) acquire(stop <-chan struct{}) (<-chan struct{}, error) {
+	if e.semaphore != nil {
+		return e.semaphore.Acquire(stop)
+	}
+	return e.consulLock.Lock(stop)
+}
+
+// release releases the lock or the semaphore slot
+func (e *Election) release() {
+	if e.semaphore != nil {
+		e.semaphore.Release()
+		return
+	}
 	e.consulLock.Unlock()
-	e.isLeader = false
 }
 
-// BeginElection starts a leader election on a go routine
+// Stop ends the election and waits for the lock to be released
+func (e *Election) Stop() {
+	e.lock.Lock()
+	cancel, done := e.cancel, e.done
+	e.lock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// BeginElection starts a leader election on a go routine.
+// Deprecated: use NewElection and Run.
 func BeginElection(serviceName string, keyPrefix string, role string) *Election {
-	key := keyPrefix + role
-	config := consul.DefaultConfig()
-	client, _ := consul.NewClient(config)
-	opts := &consul.LockOptions{
-		Key: key,
-		SessionOpts: &consul.SessionEntry{
-			Name:      serviceName,
-			LockDelay: time.Duration(5 * time.Second),
-			TTL:       "10s",
-		},
-	}
-	lock, _ := client.LockOpts(opts)
-	election := &Election{
-		electionKey: key,
-		consulLock:  lock,
-		stopChan:    make(chan struct{}, 1),
-		lockChan:    make(chan struct{}, 1),
+	return beginElection(serviceName, keyPrefix, role, 1)
+}
+
+// BeginSemaphoreElection starts an election on a go routine where up to slots instances lead at the same time.
+// The semaphore is held under the role prefix, all the instances of a role must agree on the slots.
+// Deprecated: use NewElection and Run.
+func BeginSemaphoreElection(serviceName string, keyPrefix string, role string, slots int) *Election {
+	return beginElection(serviceName, keyPrefix, role, slots)
+}
+
+func beginElection(serviceName string, keyPrefix string, role string, slots int) *Election {
+	election, err := NewElection(serviceName, keyPrefix, role, slots)
+	if err != nil {
+		log.Fatalf("Invalid election %s", err.Error())
 	}
-	go election.start()
+	ctx, done, err := election.register(context.Background())
+	if err != nil {
+		log.Fatalf("Invalid election %s", err.Error())
+	}
+	go election.run(ctx, done)
 	return election
 }
 
-// GetLeader returns leader name from Consul session
+// GetLeader returns leader name from Consul session, the first slot holder by name when elected with a semaphore
 func (e *Election) GetLeader() string {
-	config := consul.DefaultConfig()
-	client, err := consul.NewClient(config)
+	if leaders := e.GetLeaders(); len(leaders) > 0 {
+		return leaders[0]
+	}
+	return ""
+}
+
+// GetLeaders returns the names of the instances holding a slot sorted, the leader when elected with a lock.
+// The leaders are served from memory while the election runs, queried from Consul until the first watch result.
+func (e *Election) GetLeaders() []string {
+	e.lock.Lock()
+	leaders, watched := e.leaders, e.watched
+	e.lock.Unlock()
+	if watched {
+		return append([]string{}, leaders...)
+	}
+	if e.client == nil {
+		return nil
+	}
+	leaders, err := e.lookupLeaders()
 	if err != nil {
-		return ""
+		return nil
 	}
-	kvpair, _, err := client.KV().Get(e.electionKey, nil)
-	if kvpair != nil && err == nil {
-		sessionInfo, _, err := client.Session().Info(kvpair.Session, nil)
-		if err == nil {
-			return sessionInfo.Name
+	return leaders
+}
+
+// LeaderEndpoint returns the host:port of the leader, the instance of the service named after the
+// leader session that is registered for the role
+func (e *Election) LeaderEndpoint() (string, error) {
+	leader := e.GetLeader()
+	if leader == "" {
+		return "", ErrNoLeader
+	}
+	instances, _, err := NewCatalog(e.client, e.keyPrefix).Service(leader, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, instance := range instances {
+		if role, ok := instance.ElectionRole(); ok && role == e.role && instance.Address != "" {
+			return instance.Endpoint(), nil
 		}
 	}
-	return ""
+	return "", fmt.Errorf("leader %s of %s not found in catalog", leader, e.role)
 }
 
-// IsLeader returns true if the current instance is acting as leader
+// IsLeader returns true if the current instance is acting as leader or holds a slot
 func (e *Election) IsLeader() bool {
-	return e.isLeader
+	return atomic.LoadInt32(&e.isLeader) == 1
+}
+
+// Slots returns the number of instances leading at the same time
+func (e *Election) Slots() int {
+	return e.slots
 }
@@ -0,0 +1,177 @@
+package xconsul
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Timings of the election retries and watches
+type Timings struct {
+	// RetryInterval is the wait after a failed election attempt or leader query
+	RetryInterval time.Duration
+	// MaxBackoff caps the wait, doubled after every consecutive failure
+	MaxBackoff time.Duration
+	// WatchWait is the max duration of a blocking query on the election key
+	WatchWait time.Duration
+	// PriorityInterval is how often a leader looks for candidates with a higher priority
+	PriorityInterval time.Duration
+}
+
+// DefaultTimings returns the timings used unless SetTimings is called
+func DefaultTimings() Timings {
+	return Timings{
+		RetryInterval:    5 * time.Second,
+		MaxBackoff:       time.Minute,
+		WatchWait:        5 * time.Minute,
+		PriorityInterval: 5 * time.Second,
+	}
+}
+
+// backoff returns the wait after the consecutive failures
+func (t Timings) backoff(failures int) time.Duration {
+	wait := t.RetryInterval
+	for n := 1; n < failures && wait < t.MaxBackoff; n++ {
+		wait *= 2
+	}
+	if t.MaxBackoff > 0 && wait > t.MaxBackoff {
+		wait = t.MaxBackoff
+	}
+	return wait
+}
+
+// LeaderChange is a change of the leader of the role, Leaders lists the slot holders when elected with a semaphore
+type LeaderChange struct {
+	Leader   string    `json:"leader"`
+	Leaders  []string  `json:"leaders,omitempty"`
+	Previous string    `json:"previous"`
+	Time     time.Time `json:"time"`
+}
+
+// SetTimings sets the retry, backoff and watch timings, must be called before Run. Unset timings keep their default.
+func (e *Election) SetTimings(timings Timings) {
+	defaults := DefaultTimings()
+	if timings.RetryInterval <= 0 {
+		timings.RetryInterval = defaults.RetryInterval
+	}
+	if timings.MaxBackoff <= 0 {
+		timings.MaxBackoff = defaults.MaxBackoff
+	}
+	if timings.MaxBackoff < timings.RetryInterval {
+		timings.MaxBackoff = timings.RetryInterval
+	}
+	if timings.WatchWait <= 0 {
+		timings.WatchWait = defaults.WatchWait
+	}
+	if timings.PriorityInterval <= 0 {
+		timings.PriorityInterval = defaults.PriorityInterval
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.timings = timings
+}
+
+// LeaderChanged returns the leader changes seen by the watch, changes are only published once LeaderChanged
+// has been called and are dropped if the channel is not drained
+func (e *Election) LeaderChanged() <-chan LeaderChange {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.leaderChanges == nil {
+		e.leaderChanges = make(chan LeaderChange, 16)
+	}
+	return e.leaderChanges
+}
+
+// watchLeaders keeps the leaders of the role in memory with blocking queries on the election key until ctx is cancelled
+func (e *Election) watchLeaders(ctx context.Context) {
+	var index uint64
+	failures := 0
+	for ctx.Err() == nil {
+		pairs, meta, err := e.client.KV().List(e.electionKey, &consul.QueryOptions{WaitIndex: index, WaitTime: e.timings.WatchWait})
+		if ctx.Err() != nil {
+			return
+		}
+		var leaders []string
+		if err == nil {
+			leaders, err = e.electedLeaders(pairs)
+		}
+		if err != nil {
+			failures++
+			wait := e.timings.backoff(failures)
+			log.Warnf("Leader watch failed %s, retrying in %v", err.Error(), wait)
+			e.sleep(ctx, wait)
+			continue
+		}
+		failures = 0
+		if meta.LastIndex < index {
+			// the index went backwards, restart the watch
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		e.setLeaders(leaders)
+	}
+}
+
+// setLeaders caches the leaders and notifies the change, if anyone listens
+func (e *Election) setLeaders(leaders []string) {
+	e.lock.Lock()
+	previous := e.leaders
+	e.leaders = leaders
+	watched := e.watched
+	e.watched = true
+	leaderChanges := e.leaderChanges
+	e.lock.Unlock()
+	if watched && strings.Join(previous, ",") == strings.Join(leaders, ",") {
+		return
+	}
+	change := LeaderChange{Time: time.Now().UTC()}
+	if len(leaders) > 0 {
+		change.Leader = leaders[0]
+	}
+	if len(previous) > 0 {
+		change.Previous = previous[0]
+	}
+	if e.semaphore != nil {
+		change.Leaders = leaders
+	}
+	if watched {
+		log.Infof("Leader changed from %s to %s", change.Previous, change.Leader)
+	}
+	if leaderChanges == nil {
+		return
+	}
+	select {
+	case leaderChanges <- change:
+	default:
+		log.Warn("Election leader changes channel is full, dropping change")
+	}
+}
+
+// lookupLeaders queries the leaders of the role
+func (e *Election) lookupLeaders() ([]string, error) {
+	pairs, _, err := e.client.KV().List(e.electionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return e.electedLeaders(pairs)
+}
+
+// electedLeaders returns the holders of the role from the pairs listed under the election key
+func (e *Election) electedLeaders(pairs consul.KVPairs) ([]string, error) {
+	// skip the keys of the roles sharing the prefix
+	role := make(consul.KVPairs, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Key == e.electionKey || strings.HasPrefix(pair.Key, e.electionKey+"/") {
+			role = append(role, pair)
+		}
+	}
+	holders, err := NewCatalog(e.client, e.keyPrefix).ElectedHolders(role, nil)
+	if err != nil {
+		return nil, err
+	}
+	return holders[e.role], nil
+}
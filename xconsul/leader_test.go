@@ -0,0 +1,57 @@
+package xconsul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingsBackoff(t *testing.T) {
+	custom := Timings{RetryInterval: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		name     string
+		timings  Timings
+		failures int
+		expected time.Duration
+	}{
+		{"default no failure", DefaultTimings(), 0, 5 * time.Second},
+		{"default first failure", DefaultTimings(), 1, 5 * time.Second},
+		{"default doubled", DefaultTimings(), 2, 10 * time.Second},
+		{"default doubled twice", DefaultTimings(), 3, 20 * time.Second},
+		{"default capped", DefaultTimings(), 5, time.Minute},
+		{"default many failures", DefaultTimings(), 1000, time.Minute},
+		{"doubled", custom, 3, 4 * time.Second},
+		{"capped", custom, 4, 5 * time.Second},
+		{"no cap", Timings{RetryInterval: time.Second}, 3, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if wait := tt.timings.backoff(tt.failures); wait != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, wait)
+			}
+		})
+	}
+}
+
+func TestElectionSetTimings(t *testing.T) {
+	defaults := DefaultTimings()
+	tests := []struct {
+		name     string
+		timings  Timings
+		expected Timings
+	}{
+		{"unset", Timings{}, defaults},
+		{"custom", Timings{time.Second, 10 * time.Second, time.Minute, 2 * time.Second},
+			Timings{time.Second, 10 * time.Second, time.Minute, 2 * time.Second}},
+		{"max backoff below retry interval", Timings{RetryInterval: 10 * time.Second, MaxBackoff: time.Second},
+			Timings{10 * time.Second, 10 * time.Second, defaults.WatchWait, defaults.PriorityInterval}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Election{}
+			e.SetTimings(tt.timings)
+			if e.timings != tt.expected {
+				t.Fatalf("expected %+v, got %+v", tt.expected, e.timings)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package xconsul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// candidatesKey holds the candidates of each role with their priority, under the election key prefix
+const candidatesKey = ".candidates/"
+
+// candidate is the election priority of an instance, Since is the time it became ready
+type candidate struct {
+	Priority int       `json:"priority"`
+	Since    time.Time `json:"since"`
+}
+
+// SetPriority sets the election priority of the instance, must be called before Run.
+// A leader steps down to a candidate with a higher priority once the candidate has been ready for
+// the hysteresis, the candidate is ready while its process holds its candidate key and the service
+// named after it is registered for the role with passing health checks.
+func (e *Election) SetPriority(priority int, hysteresis time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.priority = priority
+	e.hysteresis = hysteresis
+}
+
+// candidateKey returns the key of the instance candidacy
+func (e *Election) candidateKey(name string) string {
+	return e.keyPrefix + candidatesKey + e.role + "/" + name
+}
+
+// advertise holds the candidate key of the instance with a session of its own until ctx is cancelled,
+// the key is deleted when the session expires
+func (e *Election) advertise(ctx context.Context) {
+	failures := 0
+	for ctx.Err() == nil {
+		if err := e.holdCandidacy(ctx); err != nil {
+			failures++
+			log.Warnf("Failed to advertise election priority %s", err.Error())
+		} else {
+			failures = 0
+		}
+		e.sleep(ctx, e.timings.backoff(failures))
+	}
+}
+
+// holdCandidacy acquires the candidate key and renews its session until ctx is cancelled
+func (e *Election) holdCandidacy(ctx context.Context) error {
+	session := e.client.Session()
+	id, _, err := session.Create(&consul.SessionEntry{Name: e.name, TTL: "10s", Behavior: "delete"}, nil)
+	if err != nil {
+		return err
+	}
+	value, _ := json.Marshal(candidate{Priority: e.priority, Since: time.Now().UTC()})
+	acquired, _, err := e.client.KV().Acquire(&consul.KVPair{Key: e.candidateKey(e.name), Value: value, Session: id}, nil)
+	if err == nil && !acquired {
+		err = errors.New("candidate key held by another session")
+	}
+	if err != nil {
+		session.Destroy(id, nil)
+		return err
+	}
+	e.lock.Lock()
+	e.candidacy = id
+	e.lock.Unlock()
+	defer func() {
+		e.lock.Lock()
+		e.candidacy = ""
+		e.lock.Unlock()
+	}()
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(done)
+	}()
+	return session.RenewPeriodic("10s", id, nil, done)
+}
+
+// deferCandidacy makes the instance ready again only after the cooldown, a candidate that stepped down
+// is not preferred while it stays out of the election
+func (e *Election) deferCandidacy(cooldown time.Duration) {
+	e.lock.Lock()
+	id := e.candidacy
+	e.lock.Unlock()
+	if id == "" {
+		return
+	}
+	value, _ := json.Marshal(candidate{Priority: e.priority, Since: time.Now().UTC().Add(cooldown)})
+	if _, _, err := e.client.KV().Acquire(&consul.KVPair{Key: e.candidateKey(e.name), Value: value, Session: id}, nil); err != nil {
+		log.Warnf("Failed to defer candidacy %s", err.Error())
+	}
+}
+
+// candidates returns the ready candidates of the role by name
+func (e *Election) candidates() (map[string]candidate, error) {
+	pairs, _, err := e.client.KV().List(e.keyPrefix+candidatesKey+e.role+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make(map[string]candidate, len(pairs))
+	for _, pair := range pairs {
+		var c candidate
+		if pair.Session == "" || json.Unmarshal(pair.Value, &c) != nil {
+			continue
+		}
+		candidates[strings.TrimPrefix(pair.Key, e.keyPrefix+candidatesKey+e.role+"/")] = c
+	}
+	return candidates, nil
+}
+
+// isCandidate returns true if the instance holds its candidate key, false if it is not running
+func (e *Election) isCandidate(name string) (bool, error) {
+	pair, _, err := e.client.KV().Get(e.candidateKey(name), nil)
+	if err != nil {
+		return false, err
+	}
+	return pair != nil && pair.Session != "", nil
+}
+
+// isHealthy returns true if the service named after the instance is registered for the role
+// and all its node and service checks pass
+func (e *Election) isHealthy(name string) (bool, error) {
+	instances, _, err := NewCatalog(e.client, e.keyPrefix).Service(name, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, instance := range instances {
+		if role, ok := instance.ElectionRole(); ok && role == e.role && instance.Health == consul.HealthPassing {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isReady returns true if the instance is a candidate and healthy, only a ready instance is handed the leadership
+func (e *Election) isReady(name string) (bool, error) {
+	if ok, err := e.isCandidate(name); !ok || err != nil {
+		return false, err
+	}
+	return e.isHealthy(name)
+}
+
+// preferredCandidate returns the candidate this instance should hand its slot to: the healthy candidate with
+// the highest priority above the priority of this instance that holds no slot and has been a candidate for
+// the hysteresis. Only the lowest priority holder steps down, ties are broken by name. Empty if none.
+func (e *Election) preferredCandidate() string {
+	candidates, err := e.candidates()
+	if err != nil || len(candidates) == 0 {
+		return ""
+	}
+	holders := e.GetLeaders()
+	holding := make(map[string]bool, len(holders))
+	for _, holder := range holders {
+		holding[holder] = true
+		if holder == e.name {
+			continue
+		}
+		if p := candidates[holder].Priority; p < e.priority || p == e.priority && holder > e.name {
+			// another holder steps down first
+			return ""
+		}
+	}
+	eligible := make([]string, 0, len(candidates))
+	for name, c := range candidates {
+		if holding[name] || name == e.name || c.Priority <= e.priority || time.Since(c.Since) < e.hysteresis {
+			continue
+		}
+		eligible = append(eligible, name)
+	}
+	sort.Slice(eligible, func(i, j int) bool {
+		a, b := candidates[eligible[i]], candidates[eligible[j]]
+		return a.Priority > b.Priority || a.Priority == b.Priority && eligible[i] < eligible[j]
+	})
+	for _, name := range eligible {
+		healthy, err := e.isHealthy(name)
+		if err != nil {
+			log.Warnf("Failed to read the health of candidate %s %s", name, err.Error())
+			return ""
+		}
+		if healthy {
+			return name
+		}
+	}
+	return ""
+}
+
+// watchPriorities steps down to a preferred candidate while ctx is not cancelled
+func (e *Election) watchPriorities(ctx context.Context) {
+	ticker := time.NewTicker(e.timings.PriorityInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if preferred := e.preferredCandidate(); preferred != "" {
+			log.Infof("Candidate %s has a higher priority, stepping down", preferred)
+			if err := e.StepDown(e.hysteresis, preferred); err != nil && err != ErrNotLeader {
+				log.Warnf("Step down to %s failed %s", preferred, err.Error())
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package xconsul
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// testCandidate is a candidate key fixture, held while session is set
+type testCandidate struct {
+	priority int
+	ready    time.Duration
+	session  string
+}
+
+// testPriorityElection returns the election of the backend role for xmicro-node1-standby with priority 1,
+// the slot holders, the candidate keys and the health of the services named after the candidates
+func testPriorityElection(t *testing.T, holders []string, candidates map[string]testCandidate, health map[string]string) *Election {
+	t.Helper()
+	pairs := make(consul.KVPairs, 0, len(candidates))
+	for name, c := range candidates {
+		value, _ := json.Marshal(candidate{Priority: c.priority, Since: time.Now().Add(-c.ready)})
+		pairs = append(pairs, &consul.KVPair{Key: testElectionPrefix + candidatesKey + "backend/" + name, Value: value, Session: c.session})
+	}
+	responses := map[string]interface{}{"/v1/kv/" + testElectionPrefix + candidatesKey + "backend/": pairs}
+	for name, status := range health {
+		entry := healthEntry{Checks: []*consul.HealthCheck{{Status: status}}}
+		entry.Node.Node = "node1"
+		entry.Node.Datacenter = "dc1"
+		entry.Service.Service = name
+		entry.Service.Tags = []string{"le", "backend"}
+		responses["/v1/health/service/"+name] = []healthEntry{entry}
+	}
+	return &Election{
+		keyPrefix:  testElectionPrefix,
+		name:       "xmicro-node1-standby",
+		role:       "backend",
+		priority:   1,
+		hysteresis: 30 * time.Second,
+		leaders:    holders,
+		watched:    true,
+		client:     testClient(t, responses),
+	}
+}
+
+func TestElectionPreferredCandidate(t *testing.T) {
+	self := []string{"xmicro-node1-standby"}
+	tests := []struct {
+		name       string
+		holders    []string
+		candidates map[string]testCandidate
+		health     map[string]string
+		expected   string
+	}{
+		{"no candidates", self, nil, nil, ""},
+		{"higher priority", self,
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, "xmicro-node1"},
+		{"within hysteresis", self,
+			map[string]testCandidate{"xmicro-node1": {2, 10 * time.Second, "s1"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, ""},
+		{"cooldown", self,
+			map[string]testCandidate{"xmicro-node1": {2, -time.Minute, "s1"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, ""},
+		{"not running", self,
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, ""}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, ""},
+		{"unhealthy", self,
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}},
+			map[string]string{"xmicro-node1": consul.HealthCritical}, ""},
+		{"not registered", self,
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}}, nil, ""},
+		{"same priority", self,
+			map[string]testCandidate{"xmicro-node2": {1, time.Minute, "s2"}},
+			map[string]string{"xmicro-node2": consul.HealthPassing}, ""},
+		{"highest priority first", self,
+			map[string]testCandidate{"xmicro-node1": {3, time.Minute, "s1"}, "xmicro-node2": {2, time.Minute, "s2"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing, "xmicro-node2": consul.HealthPassing}, "xmicro-node1"},
+		{"ties by name", self,
+			map[string]testCandidate{"xmicro-node2": {2, time.Minute, "s2"}, "xmicro-node1": {2, time.Minute, "s1"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing, "xmicro-node2": consul.HealthPassing}, "xmicro-node1"},
+		{"next healthy", self,
+			map[string]testCandidate{"xmicro-node1": {3, time.Minute, "s1"}, "xmicro-node2": {2, time.Minute, "s2"}},
+			map[string]string{"xmicro-node1": consul.HealthCritical, "xmicro-node2": consul.HealthPassing}, "xmicro-node2"},
+		{"lower priority holder steps down first", []string{"xmicro-node1-standby", "xmicro-node3"},
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}, "xmicro-node3": {0, time.Minute, "s3"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, ""},
+		{"same priority holder with a greater name steps down first", []string{"xmicro-node1-standby", "xmicro-node3"},
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}, "xmicro-node3": {1, time.Minute, "s3"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, ""},
+		{"lowest priority holder", []string{"xmicro-node1-standby", "xmicro-node0"},
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}, "xmicro-node0": {1, time.Minute, "s0"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, "xmicro-node1"},
+		{"candidate holding a slot", []string{"xmicro-node1-standby", "xmicro-node1"},
+			map[string]testCandidate{"xmicro-node1": {2, time.Minute, "s1"}},
+			map[string]string{"xmicro-node1": consul.HealthPassing}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testPriorityElection(t, tt.holders, tt.candidates, tt.health)
+			if candidate := e.preferredCandidate(); candidate != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, candidate)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package xproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	watch "github.com/hashicorp/consul/watch"
+)
+
+// APIKeyHeader is the request header holding static API keys
+const APIKeyHeader = "X-API-Key"
+
+var errNoCredentials = errors.New("missing credentials")
+
+// Identity holds the authenticated client and its verified claims
+type Identity struct {
+	Subject string
+	Method  string
+	Claims  map[string]interface{}
+}
+
+// Authenticator validates JWTs against a JWKS and static API keys stored in Consul KV
+type Authenticator struct {
+	JWKS          *JWKS
+	Issuer        string
+	Audience      string
+	APIKeysPrefix string
+	// ClaimHeaders maps verified claims to the headers forwarded upstream
+	ClaimHeaders map[string]string
+	apiKeys      map[string]string
+	lock         sync.RWMutex
+	keysWatch    *watch.WatchPlan
+}
+
+// StartAPIKeysSync loads the API keys from Consul KV and watches the prefix for changes.
+// Each key under the prefix is named after the client and holds the API key as value.
+func (a *Authenticator) StartAPIKeysSync() error {
+	if a.APIKeysPrefix == "" {
+		return nil
+	}
+	keysWatch, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": a.APIKeysPrefix})
+	if err != nil {
+		return err
+	}
+	a.keysWatch = keysWatch
+	keysWatch.Handler = func(idx uint64, data interface{}) {
+		pairs, _ := data.(consul.KVPairs)
+		a.loadAPIKeys(pairs)
+	}
+	config := consul.DefaultConfig()
+	go keysWatch.Run(config.Address)
+	return nil
+}
+
+func (a *Authenticator) loadAPIKeys(pairs consul.KVPairs) {
+	keys := make(map[string]string)
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		client := strings.TrimPrefix(pair.Key, a.APIKeysPrefix)
+		keys[hashAPIKey(strings.TrimSpace(string(pair.Value)))] = client
+	}
+	log.Infof("API keys loaded, %v clients", len(keys))
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.apiKeys = keys
+}
+
+// Authenticate verifies the bearer token or the API key of the request
+func (a *Authenticator) Authenticate(req *http.Request) (*Identity, error) {
+	if key := req.Header.Get(APIKeyHeader); key != "" {
+		a.lock.RLock()
+		client, ok := a.apiKeys[hashAPIKey(key)]
+		a.lock.RUnlock()
+		if !ok {
+			return nil, errors.New("invalid API key")
+		}
+		return &Identity{Subject: client, Method: "apikey"}, nil
+	}
+
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		if a.JWKS == nil {
+			return nil, errors.New("JWT authentication is not configured")
+		}
+		claims, err := verifyJWT(strings.TrimSpace(auth[7:]), a.JWKS, a.Issuer, a.Audience)
+		if err != nil {
+			return nil, err
+		}
+		subject, _ := claims["sub"].(string)
+		return &Identity{Subject: subject, Method: "jwt", Claims: claims}, nil
+	}
+	return nil, errNoCredentials
+}
+
+// ForwardIdentity removes client supplied identity headers and sets the verified ones
+func (a *Authenticator) ForwardIdentity(req *http.Request, identity *Identity) {
+	req.Header.Del(APIKeyHeader)
+	req.Header.Del("X-Auth-Method")
+	for _, header := range a.ClaimHeaders {
+		req.Header.Del(header)
+	}
+	if identity == nil {
+		return
+	}
+	req.Header.Set("X-Auth-Method", identity.Method)
+	for claim, header := range a.ClaimHeaders {
+		if claim == "sub" && identity.Subject != "" {
+			req.Header.Set(header, identity.Subject)
+			continue
+		}
+		if value, ok := identity.Claims[claim]; ok {
+			req.Header.Set(header, claimValue(value))
+		}
+	}
+}
+
+// Stop stops the API keys watcher and the JWKS refresh loop
+func (a *Authenticator) Stop() {
+	if a.keysWatch != nil {
+		a.keysWatch.Stop()
+	}
+	if a.JWKS != nil {
+		a.JWKS.Stop()
+	}
+}
+
+// ParseClaimHeaders parses claim to header mappings in the format claim=Header,claim=Header
+func ParseClaimHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return headers, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("xproxy: invalid claim header %s, format claim=Header", pair)
+		}
+		headers[kv[0]] = http.CanonicalHeaderKey(kv[1])
+	}
+	return headers, nil
+}
+
+func claimValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, claimValue(item))
+		}
+		return strings.Join(values, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// API keys are indexed by hash so the raw keys are not kept in memory
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,134 @@
+package xproxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy holds the cross-origin settings of a route.
+// Allowed origins can be exact like https://app.example.com, wildcards like https://*.example.com or *.
+// If no methods are set GET, HEAD and POST are allowed, if no headers are set the requested headers are allowed.
+type CORSPolicy struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty"`
+}
+
+// validate rejects a policy allowing credentials for any origin, browsers would send the credentials of every site
+func (c *CORSPolicy) validate() error {
+	if c.AllowCredentials && c.allowsAny() {
+		return errors.New("cors allow_credentials can't be used with the * origin")
+	}
+	return nil
+}
+
+// allowOrigin returns true if the origin matches an exact or wildcard allowed origin
+func (c *CORSPolicy) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := allowed[:i], allowed[i+1:]
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *CORSPolicy) allowMethod(method string) bool {
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleCORS adds the CORS response headers for allowed origins and answers preflight requests.
+// It returns true if the request was fully handled and must not be proxied.
+func (c *CORSPolicy) HandleCORS(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+	if origin == "" {
+		return false
+	}
+	if !c.allowOrigin(origin) {
+		if preflight {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+
+	h := w.Header()
+	if c.AllowCredentials || !c.allowsAny() {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(c.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	method := req.Header.Get("Access-Control-Request-Method")
+	if !c.allowMethod(method) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	if len(c.AllowedMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	} else {
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+	}
+	if len(c.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.MaxAge.Duration > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (c *CORSPolicy) allowsAny() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// stripCORSHeaders removes the upstream CORS headers so the ones set by the proxy are not duplicated
+func stripCORSHeaders(resp *http.Response) error {
+	for h := range resp.Header {
+		if strings.HasPrefix(h, "Access-Control-") {
+			resp.Header.Del(h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package xproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSAllowOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		match   bool
+	}{
+		{"exact", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"exact other scheme", []string{"https://app.example.com"}, "http://app.example.com", false},
+		{"any", []string{"*"}, "https://evil.com", true},
+		{"wildcard subdomain", []string{"https://*.example.com"}, "https://app.example.com", true},
+		{"wildcard nested subdomain", []string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{"wildcard without subdomain", []string{"https://*.example.com"}, "https://.example.com", false},
+		{"wildcard apex", []string{"https://*.example.com"}, "https://example.com", false},
+		{"wildcard other domain", []string{"https://*.example.com"}, "https://app.example.com.evil.com", false},
+		{"wildcard port", []string{"http://localhost:*"}, "http://localhost:3000", true},
+		{"second origin", []string{"https://app.example.com", "https://admin.example.com"}, "https://admin.example.com", true},
+		{"none", nil, "https://app.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &CORSPolicy{AllowedOrigins: tt.allowed}
+			if match := policy.allowOrigin(tt.origin); match != tt.match {
+				t.Fatalf("expected %v, got %v", tt.match, match)
+			}
+		})
+	}
+}
+
+func TestCORSValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CORSPolicy
+		valid  bool
+	}{
+		{"any origin", CORSPolicy{AllowedOrigins: []string{"*"}}, true},
+		{"credentials with exact origin", CORSPolicy{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}, true},
+		{"credentials with wildcard origin", CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true}, true},
+		{"credentials with any origin", CORSPolicy{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestCORSHandle(t *testing.T) {
+	policy := &CORSPolicy{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		ExposedHeaders: []string{"X-Request-Id"},
+		MaxAge:         Duration{10 * time.Minute},
+	}
+	anyOrigin := &CORSPolicy{AllowedOrigins: []string{"*"}}
+	credentials := &CORSPolicy{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}
+	tests := []struct {
+		name     string
+		policy   *CORSPolicy
+		method   string
+		origin   string
+		request  string
+		headers  string
+		handled  bool
+		status   int
+		expected map[string]string
+	}{
+		{"same origin", policy, "GET", "", "", "", false, http.StatusOK, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"allowed origin", policy, "GET", "https://app.example.com", "", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":   "https://app.example.com",
+			"Access-Control-Expose-Headers": "X-Request-Id",
+		}},
+		{"other origin", policy, "GET", "https://evil.com", "", "", false, http.StatusOK, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"any origin", anyOrigin, "GET", "https://evil.com", "", "", false, http.StatusOK, map[string]string{"Access-Control-Allow-Origin": "*"}},
+		{"credentials", credentials, "GET", "https://app.example.com", "", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin":      "https://app.example.com",
+			"Access-Control-Allow-Credentials": "true",
+		}},
+		{"preflight", policy, "OPTIONS", "https://app.example.com", "PUT", "Content-Type", true, http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":   "https://app.example.com",
+			"Access-Control-Allow-Methods":  "GET, PUT",
+			"Access-Control-Allow-Headers":  "Content-Type",
+			"Access-Control-Max-Age":        "600",
+			"Access-Control-Expose-Headers": "",
+		}},
+		{"preflight default methods", anyOrigin, "OPTIONS", "https://app.example.com", "POST", "", true, http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Methods": "GET, HEAD, POST",
+			"Access-Control-Max-Age":       "",
+		}},
+		{"preflight method not allowed", policy, "OPTIONS", "https://app.example.com", "DELETE", "", true, http.StatusForbidden, nil},
+		{"preflight origin not allowed", policy, "OPTIONS", "https://evil.com", "GET", "", true, http.StatusForbidden, nil},
+		{"options without request method", policy, "OPTIONS", "https://app.example.com", "", "", false, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.request != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.request)
+			}
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			w := httptest.NewRecorder()
+			if handled := tt.policy.HandleCORS(w, req); handled != tt.handled {
+				t.Fatalf("expected handled %v, got %v", tt.handled, handled)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("expected status %v, got %v", tt.status, w.Code)
+			}
+			if w.Header().Get("Vary") != "Origin" {
+				t.Fatalf("expected Vary Origin, got %v", w.Header()["Vary"])
+			}
+			for header, value := range tt.expected {
+				if got := w.Header().Get(header); got != value {
+					t.Fatalf("expected %s %q, got %q", header, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStripCORSHeaders(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Access-Control-Allow-Origin", "*")
+	resp.Header.Set("Access-Control-Allow-Credentials", "true")
+	resp.Header.Set("Content-Type", "text/plain")
+	stripCORSHeaders(resp)
+	if len(resp.Header) != 1 || resp.Header.Get("Content-Type") == "" {
+		t.Fatalf("expected only Content-Type, got %v", resp.Header)
+	}
+}
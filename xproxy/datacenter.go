@@ -0,0 +1,101 @@
+package xproxy
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// SetDatacenters sets the datacenters in failover priority order, the local datacenter first.
+// A service is served from the first datacenter with routable endpoints, endpoints without
+// a datacenter count as local and those of an unlisted datacenter are tried last.
+func (reg *Registry) SetDatacenters(datacenters []string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.init()
+	reg.datacenters = append([]string{}, datacenters...)
+	if len(reg.entries) == 0 {
+		return
+	}
+	entries := make(map[string]xconsul.Instances, len(reg.entries))
+	for service, instances := range reg.entries {
+		entries[service] = instances
+	}
+	reg.apply(entries, nil, nil)
+}
+
+// Datacenter returns the datacenter of the endpoint, empty if unknown
+func (s *Snapshot) Datacenter(endpoint string) string {
+	return s.endpoints[endpoint].Datacenter
+}
+
+// datacenterRank returns the failover priority of the datacenter, lower is preferred
+func (reg *Registry) datacenterRank(dc string) int {
+	if dc == "" {
+		return 0
+	}
+	for n, d := range reg.datacenters {
+		if d == dc {
+			return n
+		}
+	}
+	return len(reg.datacenters)
+}
+
+// preferredEndpoints returns the candidates of the first datacenter in priority order with a routable endpoint,
+// or of the first datacenter with candidates if none is routable
+func (reg *Registry) preferredEndpoints(service string, candidates []string, health map[string]string, datacenters map[string]string) []string {
+	if len(reg.datacenters) == 0 {
+		return candidates
+	}
+	first, preferred := -1, -1
+	for _, endpoint := range candidates {
+		rank := reg.datacenterRank(datacenters[endpoint])
+		if first < 0 || rank < first {
+			first = rank
+		}
+		if reg.routable(health[endpoint]) && (preferred < 0 || rank < preferred) {
+			preferred = rank
+		}
+	}
+	if preferred < 0 {
+		preferred = first
+	}
+	endpoints := make([]string, 0, len(candidates))
+	for _, endpoint := range candidates {
+		if reg.datacenterRank(datacenters[endpoint]) == preferred {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if preferred > first {
+		log.Warnf("xproxy: %s has no healthy endpoints in %s, failing over to %s",
+			service, reg.datacenterName(first), datacenters[endpoints[0]])
+	}
+	return endpoints
+}
+
+// datacenterName returns the datacenter with the priority
+func (reg *Registry) datacenterName(rank int) string {
+	if rank < len(reg.datacenters) {
+		return reg.datacenters[rank]
+	}
+	return "unlisted datacenters"
+}
+
+// roleInstance returns the instance of the elected service running for the role,
+// from the datacenter the role is elected in or else from the preferred datacenter
+func (reg *Registry) roleInstance(leader string, role string) (xconsul.Instance, bool) {
+	var found xconsul.Instance
+	rank := -1
+	for _, instance := range reg.entries[leader] {
+		if r, ok := instance.ElectionRole(); instance.Address == "" || !ok || r != role {
+			continue
+		}
+		if dc, ok := reg.leaderDatacenters[role]; ok && dc != "" && instance.Datacenter != dc {
+			continue
+		}
+		if n := reg.datacenterRank(instance.Datacenter); rank < 0 || n < rank {
+			found, rank = instance, n
+		}
+	}
+	return found, rank >= 0
+}
@@ -0,0 +1,42 @@
+package xproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Discovery is a service discovery backend, it loads the service instances into the registry and keeps them updated.
+// Several backends can feed the same registry, the instances of a service found in more than one backend are merged.
+type Discovery interface {
+	// Name identifies the backend instances in the registry
+	Name() string
+	// Start loads the instances into the registry and watches for changes
+	Start(registry *Registry) error
+	// Resync reloads all instances
+	Resync() error
+	// Stop stops watching for changes
+	Stop()
+}
+
+// ParseDiscovery validates a comma separated list of backends, e.g. consul,file
+func ParseDiscovery(value string) ([]string, error) {
+	backends := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, backend := range strings.Split(value, ",") {
+		backend = strings.TrimSpace(backend)
+		if backend == "" || seen[backend] {
+			continue
+		}
+		switch backend {
+		case "consul", "file", "dns", "etcd":
+		default:
+			return nil, fmt.Errorf("unknown discovery backend %s, supported: consul, file, dns, etcd", backend)
+		}
+		seen[backend] = true
+		backends = append(backends, backend)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no discovery backend set")
+	}
+	return backends, nil
+}
@@ -0,0 +1,471 @@
+package xproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	watch "github.com/hashicorp/consul/watch"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// max duration of the blocking catalog queries, a stopped service watch exits once its query returns
+const consulWatchWait = time.Minute
+
+// ConsulDiscovery keeps the registry in sync with the Consul catalog using a blocking query per service and datacenter.
+// Watch events are coalesced and applied to the registry once no new event arrives for the debounce interval,
+// or once the oldest queued event has waited for MaxDebounce, 10 times the debounce if not set.
+// Events with an already applied index are skipped. Flushes and resyncs run one at a time.
+type ConsulDiscovery struct {
+	// Address of the Consul agent, the default agent address if empty
+	Address           string
+	ElectionKeyPrefix string
+	// Datacenters to query in failover priority order, the local datacenter is queried first if not listed
+	Datacenters []string
+	// CrossDatacenterElections resolves the leaders from the election prefix of every datacenter,
+	// a role is led from the first datacenter in priority order with an elected service
+	CrossDatacenterElections bool
+	Debounce                 time.Duration
+	MaxDebounce              time.Duration
+	registry                 *Registry
+	catalog                  *xconsul.Catalog
+	lock                     sync.Mutex
+	applyLock                sync.Mutex
+	local                    string
+	servicesWatches          []*watch.WatchPlan
+	electionsWatches         []*watch.WatchPlan
+	watches                  map[string]chan struct{}
+	indexes                  map[string]uint64
+	servicesIndexes          map[string]uint64
+	electionsIndexes         map[string]uint64
+	instances                map[string]map[string]xconsul.Instances
+	changed                  map[string]bool
+	elections                map[string]consul.KVPairs
+	electionsChanged         bool
+	timer                    *time.Timer
+	pendingSince             time.Time
+	stopped                  bool
+	synced                   bool
+}
+
+// Name returns consul
+func (s *ConsulDiscovery) Name() string {
+	return "consul"
+}
+
+// Start loads the catalog and watches the services and the election KV prefix of each datacenter
+func (s *ConsulDiscovery) Start(registry *Registry) error {
+	config := consul.DefaultConfig()
+	if s.Address != "" {
+		config.Address = s.Address
+	}
+	s.Address = config.Address
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return err
+	}
+	s.registry = registry
+	s.catalog = xconsul.NewCatalog(client, s.ElectionKeyPrefix)
+	s.watches = make(map[string]chan struct{})
+	s.indexes = make(map[string]uint64)
+	s.servicesIndexes = make(map[string]uint64)
+	s.electionsIndexes = make(map[string]uint64)
+	s.instances = make(map[string]map[string]xconsul.Instances)
+	s.changed = make(map[string]bool)
+	s.elections = make(map[string]consul.KVPairs)
+
+	s.local = s.catalog.Datacenter()
+	if len(s.Datacenters) > 0 {
+		if s.local != "" && !contains(s.Datacenters, s.local) {
+			s.Datacenters = append([]string{s.local}, s.Datacenters...)
+		}
+		registry.SetDatacenters(s.Datacenters)
+	}
+	for _, dc := range s.datacenters() {
+		s.instances[dc] = make(map[string]xconsul.Instances)
+	}
+	if err := s.Resync(); err != nil {
+		log.Errorf("xproxy: consul catalog load failed %s", err.Error())
+	}
+
+	for _, dc := range s.datacenters() {
+		dc := dc
+		servicesWatch, err := watch.Parse(map[string]interface{}{"type": "services", "datacenter": dc})
+		if err != nil {
+			return err
+		}
+		servicesWatch.Handler = func(idx uint64, data interface{}) { s.handleServices(dc, idx, data) }
+		s.servicesWatches = append(s.servicesWatches, servicesWatch)
+		go servicesWatch.Run(s.Address)
+	}
+
+	for _, dc := range s.electionDatacenters() {
+		dc := dc
+		electionsWatch, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": s.ElectionKeyPrefix, "datacenter": dc})
+		if err != nil {
+			return err
+		}
+		electionsWatch.Handler = func(idx uint64, data interface{}) { s.handleElections(dc, idx, data) }
+		s.electionsWatches = append(s.electionsWatches, electionsWatch)
+		go electionsWatch.Run(s.Address)
+	}
+	return nil
+}
+
+// datacenters returns the queried datacenters in priority order, empty for the local one only
+func (s *ConsulDiscovery) datacenters() []string {
+	if len(s.Datacenters) == 0 {
+		return []string{""}
+	}
+	return s.Datacenters
+}
+
+// electionDatacenters returns the datacenters the leaders are resolved from
+func (s *ConsulDiscovery) electionDatacenters() []string {
+	if !s.CrossDatacenterElections {
+		return []string{""}
+	}
+	return s.datacenters()
+}
+
+// handleServices starts a watch for each new service of the datacenter and stops the watches of the deregistered ones
+func (s *ConsulDiscovery) handleServices(dc string, idx uint64, data interface{}) {
+	services, ok := data.(map[string][]string)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped || idx == s.servicesIndexes[dc] {
+		return
+	}
+	s.servicesIndexes[dc] = idx
+
+	for service := range services {
+		key := dc + "/" + service
+		if _, ok := s.watches[key]; ok {
+			continue
+		}
+		stop := make(chan struct{})
+		s.watches[key] = stop
+		go s.watchService(dc, service, stop)
+		log.Debugf("xproxy: watching service %s in %s", service, s.datacenterName(dc))
+	}
+	removed := false
+	for key, stop := range s.watches {
+		if !strings.HasPrefix(key, dc+"/") {
+			continue
+		}
+		service := strings.TrimPrefix(key, dc+"/")
+		if _, ok := services[service]; ok {
+			continue
+		}
+		close(stop)
+		delete(s.watches, key)
+		delete(s.indexes, key)
+		delete(s.instances[dc], service)
+		s.changed[service] = true
+		removed = true
+		log.Debugf("xproxy: service %s deregistered from %s", service, s.datacenterName(dc))
+	}
+	if removed {
+		s.schedule()
+	}
+}
+
+// watchService runs blocking catalog queries for a service of the datacenter until stopped
+func (s *ConsulDiscovery) watchService(dc string, service string, stop chan struct{}) {
+	var index uint64
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		// the vendored client can't cancel a query, the wait time bounds how long a stopped watch lingers
+		instances, meta, err := s.catalog.Service(service, &consul.QueryOptions{Datacenter: dc, WaitIndex: index, WaitTime: consulWatchWait})
+		if err != nil {
+			log.Errorf("xproxy: watch service %s in %s failed %s", service, s.datacenterName(dc), err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		// reset the index if Consul went back in time, e.g. after a restore
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		if meta.LastIndex == index {
+			continue
+		}
+		index = meta.LastIndex
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s.handleService(dc, service, index, instances)
+	}
+}
+
+// handleService queues the instances of a service in the datacenter
+func (s *ConsulDiscovery) handleService(dc string, service string, idx uint64, instances xconsul.Instances) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := dc + "/" + service
+	if s.stopped || s.watches[key] == nil || idx == s.indexes[key] {
+		return
+	}
+	s.indexes[key] = idx
+	s.instances[dc][service] = instances
+	s.changed[service] = true
+	s.schedule()
+}
+
+// handleElections queues the election KV pairs of the datacenter
+func (s *ConsulDiscovery) handleElections(dc string, idx uint64, data interface{}) {
+	pairs, _ := data.(consul.KVPairs)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped || idx == s.electionsIndexes[dc] {
+		return
+	}
+	s.electionsIndexes[dc] = idx
+	s.elections[dc] = pairs
+	s.electionsChanged = true
+	s.schedule()
+}
+
+// schedule flushes the queued changes after the debounce interval, or when the oldest queued change
+// reaches the max debounce, must be called with the lock held
+func (s *ConsulDiscovery) schedule() {
+	now := time.Now()
+	if s.pendingSince.IsZero() {
+		s.pendingSince = now
+	}
+	maxDebounce := s.MaxDebounce
+	if maxDebounce <= 0 {
+		maxDebounce = 10 * s.Debounce
+	}
+	wait := s.Debounce
+	if deadline := s.pendingSince.Add(maxDebounce).Sub(now); deadline < wait {
+		wait = deadline
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, s.flush)
+		return
+	}
+	s.timer.Reset(wait)
+}
+
+// flush applies the queued changes to the registry
+func (s *ConsulDiscovery) flush() {
+	// a flush waits for the previous one, so an older result never overwrites a newer one
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	changed, removed := make(map[string]xconsul.Instances), make([]string, 0)
+	for service := range s.changed {
+		if instances, ok := s.merged(service); ok {
+			changed[service] = instances
+		} else {
+			removed = append(removed, service)
+		}
+	}
+	pairs := make(map[string]consul.KVPairs, len(s.elections))
+	for dc, p := range s.elections {
+		pairs[dc] = p
+	}
+	electionsChanged := s.electionsChanged
+	s.changed = make(map[string]bool)
+	s.electionsChanged = false
+	s.timer = nil
+	s.pendingSince = time.Time{}
+	synced := s.synced
+	s.lock.Unlock()
+
+	if !synced {
+		// the catalog was never loaded, replace the registry instead of updating it
+		if err := s.resync(); err != nil {
+			log.Errorf("xproxy: consul catalog load failed %s", err.Error())
+			s.lock.Lock()
+			if s.timer == nil && !s.stopped {
+				s.timer = time.AfterFunc(5*time.Second, s.flush)
+			}
+			s.lock.Unlock()
+		}
+		return
+	}
+
+	var state *ElectionState
+	if electionsChanged {
+		var err error
+		state, err = s.resolveElections(func(dc string) (consul.KVPairs, error) {
+			if p, ok := pairs[dc]; ok {
+				return p, nil
+			}
+			// the watch of the datacenter didn't fire yet
+			return s.catalog.ElectionPairs(&consul.QueryOptions{Datacenter: dc})
+		})
+		if err != nil {
+			// keep the current leaders and retry with the next flush
+			log.Errorf("xproxy: resolve leaders failed %s", err.Error())
+			s.lock.Lock()
+			s.electionsChanged = true
+			s.schedule()
+			s.lock.Unlock()
+			state = nil
+		}
+	}
+	s.registry.UpdateElections(s.Name(), changed, removed, state)
+	log.Infof("Registry updated, %v services changed, %v removed, leaders changed %v", len(changed), len(removed), state != nil)
+}
+
+// merged returns the instances of the service in all datacenters, in priority order,
+// false if no datacenter has the service, must be called with the lock held
+func (s *ConsulDiscovery) merged(service string) (xconsul.Instances, bool) {
+	merged := make(xconsul.Instances, 0)
+	found := false
+	for _, dc := range s.datacenters() {
+		if instances, ok := s.instances[dc][service]; ok {
+			merged = append(merged, instances...)
+			found = true
+		}
+	}
+	return merged, found
+}
+
+// resolveElections merges the elections of each datacenter, the first datacenter in priority order
+// with an elected service wins a role, with the datacenter, the slot holders and the fencing tokens of each role
+func (s *ConsulDiscovery) resolveElections(electionPairs func(dc string) (consul.KVPairs, error)) (*ElectionState, error) {
+	elections := make(map[string]string)
+	holders := make(map[string][]string)
+	tokens := make(map[string]map[string]uint64)
+	datacenters := make(map[string]string)
+	for _, dc := range s.electionDatacenters() {
+		pairs, err := electionPairs(dc)
+		if err != nil {
+			return nil, err
+		}
+		e, err := s.catalog.ElectedHolders(pairs, &consul.QueryOptions{Datacenter: dc})
+		if err != nil {
+			return nil, err
+		}
+		fencing, err := s.catalog.FencingTokens(pairs, &consul.QueryOptions{Datacenter: dc})
+		if err != nil {
+			return nil, err
+		}
+		for role, services := range e {
+			if _, ok := elections[role]; ok || len(services) == 0 {
+				continue
+			}
+			elections[role] = services[0]
+			holders[role] = services
+			tokens[role] = fencing[role]
+			datacenters[role] = dc
+			if dc == "" {
+				datacenters[role] = s.local
+			}
+		}
+	}
+	return &ElectionState{Leaders: elections, Holders: holders, Tokens: tokens, Datacenters: datacenters}, nil
+}
+
+// Resync reloads all services and elections from the Consul catalog of each datacenter
+func (s *ConsulDiscovery) Resync() error {
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+	return s.resync()
+}
+
+// resync reloads the catalog, must be called with the apply lock held
+func (s *ConsulDiscovery) resync() error {
+	loaded := make(map[string]map[string]xconsul.Instances)
+	for _, dc := range s.datacenters() {
+		q := &consul.QueryOptions{Datacenter: dc}
+		services, err := s.catalog.Services(q)
+		if err != nil {
+			return err
+		}
+		loaded[dc] = make(map[string]xconsul.Instances, len(services))
+		for _, service := range services {
+			i, _, err := s.catalog.Service(service, q)
+			if err != nil {
+				return err
+			}
+			loaded[dc][service] = i
+		}
+	}
+	state, err := s.resolveElections(func(dc string) (consul.KVPairs, error) {
+		return s.catalog.ElectionPairs(&consul.QueryOptions{Datacenter: dc})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	for dc, instances := range loaded {
+		s.instances[dc] = instances
+	}
+	instances := make(map[string]xconsul.Instances)
+	for _, dc := range s.datacenters() {
+		for service := range s.instances[dc] {
+			instances[service], _ = s.merged(service)
+		}
+	}
+	s.synced = true
+	s.lock.Unlock()
+
+	s.registry.ReplaceElections(s.Name(), instances, state)
+	return nil
+}
+
+// datacenterName returns the datacenter name for logging
+func (s *ConsulDiscovery) datacenterName(dc string) string {
+	if dc == "" {
+		return "the local datacenter"
+	}
+	return dc
+}
+
+// Stop stops all watches and drops the queued changes
+func (s *ConsulDiscovery) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	for _, w := range s.servicesWatches {
+		w.Stop()
+	}
+	for _, w := range s.electionsWatches {
+		w.Stop()
+	}
+	for key, stop := range s.watches {
+		close(stop)
+		delete(s.watches, key)
+	}
+}
+
+// contains returns true if the value is in the list
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
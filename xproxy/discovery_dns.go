@@ -0,0 +1,143 @@
+package xproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// DNSDiscovery resolves the service instances from DNS SRV records at a fixed interval.
+// Each SRV target is resolved to its addresses, every address becomes an instance.
+type DNSDiscovery struct {
+	// Records maps the service names to SRV record names, e.g. web: _http._tcp.web.example.com
+	Records  map[string]string
+	Interval time.Duration
+	registry *Registry
+	stop     chan struct{}
+	lock     sync.Mutex
+}
+
+// ParseDNSRecords parses a service=record list, e.g. web=_http._tcp.web.example.com,api=_http._tcp.api.example.com
+func ParseDNSRecords(value string) (map[string]string, error) {
+	records := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid DNS record %s, format: service=record", pair)
+		}
+		records[parts[0]] = parts[1]
+	}
+	return records, nil
+}
+
+// Name returns dns
+func (d *DNSDiscovery) Name() string {
+	return "dns"
+}
+
+// Start resolves the records and keeps resolving them every interval
+func (d *DNSDiscovery) Start(registry *Registry) error {
+	d.registry = registry
+	if err := d.Resync(); err != nil {
+		log.Errorf("xproxy: DNS discovery failed %s", err.Error())
+	}
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	stop := make(chan struct{})
+	d.lock.Lock()
+	d.stop = stop
+	d.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := d.Resync(); err != nil {
+					log.Errorf("xproxy: DNS discovery failed %s", err.Error())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Resync resolves all records and replaces the instances in the registry.
+// Services whose lookup fails keep their last resolved instances.
+func (d *DNSDiscovery) Resync() error {
+	instances := make(map[string]xconsul.Instances, len(d.Records))
+	failed := make([]string, 0)
+	for service, record := range d.Records {
+		i, err := d.resolve(service, record)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s", service, err.Error()))
+			continue
+		}
+		instances[service] = i
+	}
+	if len(failed) > 0 {
+		d.registry.Update(d.Name(), instances, nil, nil)
+		return fmt.Errorf("lookup failed for %s", strings.Join(failed, ", "))
+	}
+	d.registry.Replace(d.Name(), instances, map[string]string{})
+	return nil
+}
+
+// resolve returns the instances of the SRV record targets, targets that don't resolve are skipped
+// and the lookup fails only if none resolves
+func (d *DNSDiscovery) resolve(service string, record string) (xconsul.Instances, error) {
+	_, srvs, err := net.LookupSRV("", "", record)
+	if err != nil {
+		return nil, err
+	}
+	instances := make(xconsul.Instances, 0, len(srvs))
+	var lookupErr error
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addresses, err := net.LookupHost(target)
+		if err != nil {
+			log.Warnf("xproxy: DNS lookup of %s target %s failed %s", service, target, err.Error())
+			lookupErr = err
+			continue
+		}
+		for _, address := range addresses {
+			instances = append(instances, xconsul.Instance{
+				ID:      fmt.Sprintf("%s-%s-%v", service, address, srv.Port),
+				Service: service,
+				Address: address,
+				Port:    int(srv.Port),
+				Node:    target,
+				Health:  consul.HealthPassing,
+				Checks:  []*consul.HealthCheck{{Status: consul.HealthPassing, Output: "dns"}},
+			})
+		}
+	}
+	if len(instances) == 0 && lookupErr != nil {
+		return nil, lookupErr
+	}
+	return instances, nil
+}
+
+// Stop stops resolving the records
+func (d *DNSDiscovery) Stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
@@ -0,0 +1,246 @@
+package xproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// EtcdDiscovery loads the service instances from etcd v3 through its JSON gateway and watches the prefix for changes.
+// Instances are stored as JSON, in the discovery file instance format, under <prefix><service>/<id>.
+type EtcdDiscovery struct {
+	// Endpoints are the etcd client URLs, e.g. http://127.0.0.1:2379, tried in order
+	Endpoints []string
+	Prefix    string
+	// APIPrefix is the gateway path, /v3 for etcd 3.4 and later, /v3beta for 3.3
+	APIPrefix string
+	registry  *Registry
+	client    *http.Client
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header   etcdHeader        `json:"header"`
+		Events   []json.RawMessage `json:"events"`
+		Canceled bool              `json:"canceled"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Name returns etcd
+func (e *EtcdDiscovery) Name() string {
+	return "etcd"
+}
+
+// Start loads the prefix and watches it for changes
+func (e *EtcdDiscovery) Start(registry *Registry) error {
+	if len(e.Endpoints) == 0 {
+		return fmt.Errorf("etcd discovery requires at least one endpoint")
+	}
+	if e.APIPrefix == "" {
+		e.APIPrefix = "/v3"
+	}
+	e.registry = registry
+	e.client = &http.Client{}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.lock.Lock()
+	e.cancel = cancel
+	e.lock.Unlock()
+	go e.watch(ctx)
+	return nil
+}
+
+// watch loads the prefix, then streams the changes from the next revision and reloads on every change
+func (e *EtcdDiscovery) watch(ctx context.Context) {
+	for {
+		revision, err := e.load(ctx)
+		if err == nil {
+			err = e.stream(ctx, revision+1)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("xproxy: etcd discovery failed %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Resync reloads all instances from etcd
+func (e *EtcdDiscovery) Resync() error {
+	_, err := e.load(context.Background())
+	return err
+}
+
+// load reads the prefix and replaces the instances in the registry, it returns the etcd revision
+func (e *EtcdDiscovery) load(ctx context.Context) (int64, error) {
+	var response etcdRangeResponse
+	err := e.post(ctx, "/kv/range", e.keyRange(nil), func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&response)
+	})
+	if err != nil {
+		return 0, err
+	}
+	instances := make(map[string]xconsul.Instances)
+	for _, kv := range response.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), e.Prefix)
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		var i fileInstance
+		if err := json.Unmarshal(kv.Value, &i); err != nil || i.Address == "" || i.Port == 0 {
+			log.Warnf("xproxy: invalid etcd instance %s", string(kv.Key))
+			continue
+		}
+		if i.ID == "" {
+			i.ID = parts[1]
+		}
+		if i.Health == "" {
+			i.Health = consul.HealthPassing
+		}
+		instances[parts[0]] = append(instances[parts[0]], xconsul.Instance{
+			ID:         i.ID,
+			Service:    parts[0],
+			Address:    i.Address,
+			Port:       i.Port,
+			Tags:       i.Tags,
+			Meta:       i.Meta,
+			Node:       i.Node,
+			Datacenter: i.Datacenter,
+			Health:     i.Health,
+			Checks:     []*consul.HealthCheck{{Status: i.Health, Output: "etcd"}},
+		})
+	}
+	e.registry.Replace(e.Name(), instances, map[string]string{})
+	revision, _ := strconv.ParseInt(response.Header.Revision, 10, 64)
+	return revision, nil
+}
+
+// stream watches the prefix from the revision and reloads the prefix on every batch of events
+func (e *EtcdDiscovery) stream(ctx context.Context, revision int64) error {
+	request := map[string]interface{}{
+		"create_request": e.keyRange(map[string]interface{}{"start_revision": strconv.FormatInt(revision, 10)}),
+	}
+	return e.post(ctx, "/watch", request, func(body io.Reader) error {
+		decoder := json.NewDecoder(body)
+		for {
+			var response etcdWatchResponse
+			if err := decoder.Decode(&response); err != nil {
+				return err
+			}
+			if response.Error != nil {
+				return fmt.Errorf("watch %s", response.Error.Message)
+			}
+			if response.Result.Canceled {
+				return fmt.Errorf("watch canceled")
+			}
+			if len(response.Result.Events) == 0 {
+				continue
+			}
+			if _, err := e.load(ctx); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// keyRange returns the range request of the prefix
+func (e *EtcdDiscovery) keyRange(extra map[string]interface{}) map[string]interface{} {
+	key := []byte(e.Prefix)
+	end := append([]byte{}, key...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			end = end[:i+1]
+			break
+		}
+	}
+	request := map[string]interface{}{
+		"key":       base64.StdEncoding.EncodeToString(key),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	}
+	if len(key) == 0 {
+		request["key"] = base64.StdEncoding.EncodeToString([]byte{0})
+		request["range_end"] = base64.StdEncoding.EncodeToString([]byte{0})
+	}
+	for k, v := range extra {
+		request[k] = v
+	}
+	return request
+}
+
+// post sends the request to the first endpoint that answers
+func (e *EtcdDiscovery) post(ctx context.Context, path string, request interface{}, handle func(io.Reader) error) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range e.Endpoints {
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+e.APIPrefix+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := e.client.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s returned %v", endpoint, resp.StatusCode)
+			continue
+		}
+		err = handle(resp.Body)
+		resp.Body.Close()
+		return err
+	}
+	return lastErr
+}
+
+// Stop stops watching etcd
+func (e *EtcdDiscovery) Stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+}
@@ -0,0 +1,170 @@
+package xproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileCatalog is the static discovery file format, YAML if the file extension is .yaml or .yml, JSON otherwise.
+//
+//	services:
+//	  web:
+//	    - address: 10.0.0.1
+//	      port: 8000
+//	      tags: [v2]
+//	      meta: {version: "2"}
+//	leaders:
+//	  storage: storage1
+type fileCatalog struct {
+	Services map[string][]fileInstance `json:"services" yaml:"services"`
+	Leaders  map[string]string         `json:"leaders" yaml:"leaders"`
+}
+
+type fileInstance struct {
+	ID         string            `json:"id" yaml:"id"`
+	Address    string            `json:"address" yaml:"address"`
+	Port       int               `json:"port" yaml:"port"`
+	Tags       []string          `json:"tags" yaml:"tags"`
+	Meta       map[string]string `json:"meta" yaml:"meta"`
+	Node       string            `json:"node" yaml:"node"`
+	Datacenter string            `json:"datacenter" yaml:"datacenter"`
+	Health     string            `json:"health" yaml:"health"`
+}
+
+// FileDiscovery loads the service instances from a static YAML or JSON file and reloads it on changes.
+// It is meant for local development and tests without a Consul agent.
+type FileDiscovery struct {
+	Path     string
+	registry *Registry
+	watcher  *fsnotify.Watcher
+	lock     sync.Mutex
+}
+
+// Name returns file
+func (f *FileDiscovery) Name() string {
+	return "file"
+}
+
+// Start loads the file and watches its directory, so files replaced by editors or config maps are reloaded too
+func (f *FileDiscovery) Start(registry *Registry) error {
+	f.registry = registry
+	if err := f.Resync(); err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(f.Path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	f.lock.Lock()
+	f.watcher = watcher
+	f.lock.Unlock()
+	go f.watch(watcher)
+	return nil
+}
+
+// watch reloads the file once the write events settle
+func (f *FileDiscovery) watch(watcher *fsnotify.Watcher) {
+	name := filepath.Clean(f.Path)
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == name {
+				reload = time.After(100 * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("xproxy: discovery file watch failed %s", err.Error())
+		case <-reload:
+			reload = nil
+			if err := f.Resync(); err != nil {
+				log.Errorf("xproxy: discovery file reload failed, keeping the loaded instances %s", err.Error())
+			}
+		}
+	}
+}
+
+// Resync reads the file and replaces the instances in the registry
+func (f *FileDiscovery) Resync() error {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	var catalog fileCatalog
+	switch strings.ToLower(filepath.Ext(f.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &catalog)
+	default:
+		err = json.Unmarshal(data, &catalog)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s", f.Path, err.Error())
+	}
+
+	instances := make(map[string]xconsul.Instances, len(catalog.Services))
+	for service, entries := range catalog.Services {
+		list := make(xconsul.Instances, 0, len(entries))
+		for _, e := range entries {
+			if e.Address == "" || e.Port == 0 {
+				return fmt.Errorf("%s service %s address and port are required", f.Path, service)
+			}
+			if e.Health == "" {
+				e.Health = consul.HealthPassing
+			}
+			if e.ID == "" {
+				e.ID = service + "-" + e.Address + "-" + strconv.Itoa(e.Port)
+			}
+			list = append(list, xconsul.Instance{
+				ID:         e.ID,
+				Service:    service,
+				Address:    e.Address,
+				Port:       e.Port,
+				Tags:       e.Tags,
+				Meta:       e.Meta,
+				Node:       e.Node,
+				Datacenter: e.Datacenter,
+				Health:     e.Health,
+				Checks:     []*consul.HealthCheck{{Status: e.Health, Output: "static"}},
+			})
+		}
+		instances[service] = list
+	}
+	elections := catalog.Leaders
+	if elections == nil {
+		elections = map[string]string{}
+	}
+	f.registry.Replace(f.Name(), instances, elections)
+	log.Infof("Discovery file %s loaded, %v services", f.Path, len(instances))
+	return nil
+}
+
+// Stop stops watching the file
+func (f *FileDiscovery) Stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.watcher != nil {
+		f.watcher.Close()
+		f.watcher = nil
+	}
+}
@@ -0,0 +1,202 @@
+package xproxy
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Registry event types
+const (
+	EventServiceAdded    = "service_added"
+	EventServiceGone     = "service_gone"
+	EventEndpointAdded   = "endpoint_added"
+	EventEndpointRemoved = "endpoint_removed"
+	EventHealthChanged   = "health_changed"
+	EventLeaderChanged   = "leader_changed"
+)
+
+// eventHistory is the number of events kept for long-poll and stream resumption
+const eventHistory = 1024
+
+// Event is a registry change, Version is the snapshot version that introduced it.
+// Endpoint events refer to routable endpoints, health events to any endpoint.
+type Event struct {
+	Version  uint64    `json:"version"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Service  string    `json:"service"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Health   string    `json:"health,omitempty"`
+	Leader   string    `json:"leader,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+}
+
+// Subscribe returns a channel receiving the registry events and a function to cancel the subscription.
+// Subscribers that fall more than buffer events behind are dropped, their channel is closed
+// and they should reload the registry before subscribing again.
+func (reg *Registry) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	reg.eventsLock.Lock()
+	defer reg.eventsLock.Unlock()
+	if reg.subscribers == nil {
+		reg.subscribers = make(map[chan Event]bool)
+	}
+	reg.subscribers[ch] = true
+	return ch, func() {
+		reg.eventsLock.Lock()
+		defer reg.eventsLock.Unlock()
+		if reg.subscribers[ch] {
+			delete(reg.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Events returns the events newer than the version.
+// It returns false if older events were already discarded and the caller must reload the registry.
+func (reg *Registry) Events(since uint64) ([]Event, bool) {
+	reg.eventsLock.Lock()
+	defer reg.eventsLock.Unlock()
+	return reg.eventsSince(since)
+}
+
+// WaitEvents returns the events newer than the version, waiting up to timeout for new ones
+func (reg *Registry) WaitEvents(since uint64, timeout time.Duration) ([]Event, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		reg.eventsLock.Lock()
+		events, ok := reg.eventsSince(since)
+		if len(events) > 0 || !ok {
+			reg.eventsLock.Unlock()
+			return events, ok
+		}
+		if reg.notify == nil {
+			reg.notify = make(chan struct{})
+		}
+		notify := reg.notify
+		reg.eventsLock.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline.C:
+			return []Event{}, true
+		}
+	}
+}
+
+// eventsSince must be called with the events lock held. A version newer than the current one was
+// issued before a restart, the events in between are unknown and the caller must reload as well.
+func (reg *Registry) eventsSince(since uint64) ([]Event, bool) {
+	if since > reg.Snapshot().Version {
+		return []Event{}, false
+	}
+	i := sort.Search(len(reg.history), func(i int) bool { return reg.history[i].Version > since })
+	complete := reg.historyStart == 0 || since >= reg.historyStart
+	return append([]Event{}, reg.history[i:]...), complete
+}
+
+// emit records the events and sends them to the subscribers, slow subscribers are dropped
+func (reg *Registry) emit(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	reg.eventsLock.Lock()
+	defer reg.eventsLock.Unlock()
+	reg.history = append(reg.history, events...)
+	if len(reg.history) > eventHistory {
+		reg.history = append([]Event{}, reg.history[len(reg.history)-eventHistory:]...)
+		reg.historyStart = reg.history[0].Version
+	}
+	for ch := range reg.subscribers {
+		for _, e := range events {
+			select {
+			case ch <- e:
+			default:
+				log.Warnf("xproxy: registry subscriber dropped, %v events behind", cap(ch))
+				delete(reg.subscribers, ch)
+				close(ch)
+			}
+			if !reg.subscribers[ch] {
+				break
+			}
+		}
+	}
+	if reg.notify != nil {
+		close(reg.notify)
+		reg.notify = nil
+	}
+	for _, e := range events {
+		log.Debugf("xproxy: registry version %v %s %s %s%s", e.Version, e.Type, e.Service, e.Endpoint, e.Leader)
+	}
+}
+
+// diffSnapshots returns the changes between two snapshots
+func diffSnapshots(prev *Snapshot, next *Snapshot) []Event {
+	events := make([]Event, 0)
+	add := func(e Event) {
+		e.Version = next.Version
+		e.Time = next.Updated
+		events = append(events, e)
+	}
+
+	services := make(map[string]bool)
+	for service := range prev.Health {
+		services[service] = true
+	}
+	for service := range next.Health {
+		services[service] = true
+	}
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+
+	for _, service := range names {
+		before, existed := prev.Health[service]
+		after, exists := next.Health[service]
+		if !existed {
+			add(Event{Type: EventServiceAdded, Service: service})
+		}
+		endpoints := make([]string, 0, len(after))
+		for endpoint := range after {
+			endpoints = append(endpoints, endpoint)
+		}
+		sort.Strings(endpoints)
+		for _, endpoint := range endpoints {
+			if old, ok := before[endpoint]; ok && old != after[endpoint] {
+				add(Event{Type: EventHealthChanged, Service: service, Endpoint: endpoint, Health: after[endpoint], Previous: old})
+			}
+		}
+		routableBefore := make(map[string]bool)
+		for _, endpoint := range prev.Catalog[service] {
+			routableBefore[endpoint] = true
+		}
+		routableAfter := make(map[string]bool)
+		for _, endpoint := range next.Catalog[service] {
+			routableAfter[endpoint] = true
+			if !routableBefore[endpoint] {
+				add(Event{Type: EventEndpointAdded, Service: service, Endpoint: endpoint, Health: after[endpoint]})
+			}
+		}
+		for _, endpoint := range prev.Catalog[service] {
+			if !routableAfter[endpoint] {
+				health, ok := after[endpoint]
+				if !ok {
+					health = before[endpoint]
+				}
+				add(Event{Type: EventEndpointRemoved, Service: service, Endpoint: endpoint, Health: health})
+			}
+		}
+		if prev.Leaders[service] != next.Leaders[service] {
+			add(Event{Type: EventLeaderChanged, Service: service, Leader: next.Leaders[service], Previous: prev.Leaders[service]})
+		}
+		if existed && !exists {
+			add(Event{Type: EventServiceGone, Service: service})
+		}
+	}
+	return events
+}
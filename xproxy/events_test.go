@@ -0,0 +1,49 @@
+package xproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+func TestRegistryEventsSince(t *testing.T) {
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 1)}, nil)
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 2)}, nil)
+	current := reg.Snapshot().Version
+
+	tests := []struct {
+		name     string
+		since    uint64
+		events   bool
+		complete bool
+	}{
+		{"from the start", 0, true, true},
+		{"from the previous version", current - 1, true, true},
+		{"up to date", current, false, true},
+		{"version issued before a restart", current + 10, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, complete := reg.Events(tt.since)
+			if complete != tt.complete {
+				t.Fatalf("expected complete %v, got %v", tt.complete, complete)
+			}
+			if (len(events) > 0) != tt.events {
+				t.Fatalf("expected events %v, got %v", tt.events, events)
+			}
+			for _, e := range events {
+				if e.Version <= tt.since {
+					t.Fatalf("event %v is not newer than %v", e.Version, tt.since)
+				}
+			}
+		})
+	}
+
+	// a long poll from a future version returns at once asking for a resync
+	start := time.Now()
+	if _, complete := reg.WaitEvents(current+10, time.Second); complete || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected an immediate resync, complete %v after %v", complete, time.Since(start))
+	}
+}
@@ -0,0 +1,20 @@
+package xproxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// fence sets the fencing token of the holder of the endpoint on requests routed to an elected role,
+// the header is removed from requests to other services and to endpoints without a known token
+func (s *Snapshot) fence(req *http.Request, service string, endpoint string) {
+	if instance, ok := s.endpoints[endpoint]; ok {
+		if token, ok := s.Tokens[service][instance.Service]; ok {
+			req.Header.Set(xconsul.FencingTokenHeader, strconv.FormatUint(token, 10))
+			return
+		}
+	}
+	req.Header.Del(xconsul.FencingTokenHeader)
+}
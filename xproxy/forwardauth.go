@@ -0,0 +1,197 @@
+package xproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// max number of cached decisions before expired entries are evicted
+const forwardAuthCacheSize = 10000
+
+// max number of auth service instances tried by a subrequest
+const forwardAuthAttempts = 3
+
+// ForwardAuth holds the external authorization settings of a route.
+// Before proxying, a subrequest carrying the original method, URI and the selected request headers
+// is sent to the auth service. A 2xx response allows the request and the selected response headers
+// are copied onto the upstream request, any other 4xx response is returned to the client.
+type ForwardAuth struct {
+	Service         string   `json:"service"`
+	Path            string   `json:"path,omitempty"`
+	RequestHeaders  []string `json:"request_headers,omitempty"`
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+	CacheTTL        Duration `json:"cache_ttl,omitempty"`
+	Timeout         Duration `json:"timeout,omitempty"`
+	FailOpen        bool     `json:"fail_open,omitempty"`
+}
+
+// authDecision is the cached outcome of a forward auth subrequest
+type authDecision struct {
+	allow   bool
+	status  int
+	body    string
+	headers http.Header
+	expires time.Time
+}
+
+// forwardAuthorizer sends the forward auth subrequests and caches the decisions
+type forwardAuthorizer struct {
+	registry *Registry
+	scheme   string
+	client   *http.Client
+	cache    map[string]authDecision
+	lock     sync.Mutex
+}
+
+func newForwardAuthorizer(registry *Registry, scheme string) *forwardAuthorizer {
+	return &forwardAuthorizer{
+		registry: registry,
+		scheme:   scheme,
+		client:   &http.Client{},
+		cache:    make(map[string]authDecision),
+	}
+}
+
+// authorize returns the decision for the request, from cache if available
+func (f *forwardAuthorizer) authorize(req *http.Request, service string, fa *ForwardAuth) authDecision {
+	key := f.cacheKey(req, fa)
+	if fa.CacheTTL.Duration > 0 {
+		f.lock.Lock()
+		decision, ok := f.cache[key]
+		f.lock.Unlock()
+		if ok && time.Now().Before(decision.expires) {
+			return decision
+		}
+	}
+
+	decision, err := f.callout(req, fa)
+	if err != nil {
+		log.Warnf("xproxy: forward auth %s for %s failed %s", fa.Service, service, err.Error())
+		xproxy_forward_auth_total.WithLabelValues(service, "error").Inc()
+		if fa.FailOpen {
+			return authDecision{allow: true}
+		}
+		return authDecision{status: http.StatusServiceUnavailable, body: "Service Unavailable"}
+	}
+	if decision.allow {
+		xproxy_forward_auth_total.WithLabelValues(service, "allow").Inc()
+	} else {
+		xproxy_forward_auth_total.WithLabelValues(service, "deny").Inc()
+	}
+
+	if fa.CacheTTL.Duration > 0 {
+		decision.expires = time.Now().Add(fa.CacheTTL.Duration)
+		f.lock.Lock()
+		if len(f.cache) >= forwardAuthCacheSize {
+			f.evict()
+		}
+		f.cache[key] = decision
+		f.lock.Unlock()
+	}
+	return decision
+}
+
+// callout sends the subrequest to a random instance of the auth service and fails over to another instance
+// on 5xx responses and transport errors, if every attempt fails the error is returned so the fail mode applies
+func (f *forwardAuthorizer) callout(req *http.Request, fa *ForwardAuth) (authDecision, error) {
+	endpoints, err := f.registry.Lookup(fa.Service)
+	if err != nil || len(endpoints) == 0 {
+		return authDecision{}, fmt.Errorf("auth service %s not found in registry", fa.Service)
+	}
+	for n, i := range rand.Perm(len(endpoints)) {
+		if n == forwardAuthAttempts {
+			break
+		}
+		var decision authDecision
+		decision, err = f.send(req, fa, endpoints[i])
+		if err == nil {
+			return decision, nil
+		}
+		log.Debugf("xproxy: forward auth %s instance %s failed %s", fa.Service, endpoints[i], err.Error())
+	}
+	return authDecision{}, err
+}
+
+// send sends the subrequest to the auth service endpoint,
+// 5xx responses and transport errors are reported as errors
+func (f *forwardAuthorizer) send(req *http.Request, fa *ForwardAuth, endpoint string) (authDecision, error) {
+	path := fa.Path
+	if path == "" {
+		path = "/"
+	}
+	sub, err := http.NewRequest(http.MethodGet, f.scheme+"://"+endpoint+path, nil)
+	if err != nil {
+		return authDecision{}, err
+	}
+	sub.Header.Set("X-Forwarded-Method", req.Method)
+	sub.Header.Set("X-Forwarded-Uri", req.RequestURI)
+	sub.Header.Set("X-Forwarded-Host", req.Host)
+	for _, h := range fa.RequestHeaders {
+		if values, ok := req.Header[http.CanonicalHeaderKey(h)]; ok {
+			sub.Header[http.CanonicalHeaderKey(h)] = values
+		}
+	}
+
+	timeout := fa.Timeout.Duration
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	client := *f.client
+	client.Timeout = timeout
+	resp, err := client.Do(sub)
+	if err != nil {
+		return authDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return authDecision{}, fmt.Errorf("auth service %s returned status %v", fa.Service, resp.StatusCode)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		headers := make(http.Header)
+		for _, h := range fa.ResponseHeaders {
+			if values, ok := resp.Header[http.CanonicalHeaderKey(h)]; ok {
+				headers[http.CanonicalHeaderKey(h)] = values
+			}
+		}
+		return authDecision{allow: true, status: resp.StatusCode, headers: headers}, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	status := resp.StatusCode
+	if status < 400 {
+		status = http.StatusForbidden
+	}
+	return authDecision{status: status, body: string(body)}, nil
+}
+
+// decisions are cached per method, URI and selected request headers
+func (f *forwardAuthorizer) cacheKey(req *http.Request, fa *ForwardAuth) string {
+	parts := []string{fa.Service, req.Method, req.Host, req.RequestURI}
+	for _, h := range fa.RequestHeaders {
+		parts = append(parts, strings.Join(req.Header[http.CanonicalHeaderKey(h)], ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// evict removes expired decisions, if the cache is still full it gets cleared
+func (f *forwardAuthorizer) evict() {
+	now := time.Now()
+	for k, d := range f.cache {
+		if now.After(d.expires) {
+			delete(f.cache, k)
+		}
+	}
+	if len(f.cache) >= forwardAuthCacheSize {
+		f.cache = make(map[string]authDecision)
+	}
+}
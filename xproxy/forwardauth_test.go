@@ -0,0 +1,145 @@
+package xproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// testAuthService registers the test servers as the instances of the auth service
+func testAuthService(t *testing.T, reg *Registry, servers ...*httptest.Server) {
+	t.Helper()
+	instances := make(xconsul.Instances, 0, len(servers))
+	for n, server := range servers {
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		p, _ := strconv.Atoi(port)
+		instances = append(instances, xconsul.Instance{
+			ID:      "auth-" + strconv.Itoa(n),
+			Service: "auth",
+			Address: host,
+			Port:    p,
+			Health:  consul.HealthPassing,
+		})
+	}
+	reg.Replace("consul", map[string]xconsul.Instances{"auth": instances}, nil)
+}
+
+func TestForwardAuthDecisions(t *testing.T) {
+	handler := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Forwarded-Method") != "POST" || r.Header.Get("X-Forwarded-Uri") != "/api/orders" {
+				t.Errorf("expected the original method and URI, got %s %s",
+					r.Header.Get("X-Forwarded-Method"), r.Header.Get("X-Forwarded-Uri"))
+			}
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Internal", "secret")
+			w.WriteHeader(status)
+			w.Write([]byte("decision"))
+		}
+	}
+	tests := []struct {
+		name     string
+		statuses []int
+		failOpen bool
+		allow    bool
+		status   int
+	}{
+		{"allow", []int{http.StatusOK}, false, true, http.StatusOK},
+		{"deny", []int{http.StatusUnauthorized}, false, false, http.StatusUnauthorized},
+		{"redirect is denied", []int{http.StatusFound}, false, false, http.StatusForbidden},
+		{"fail over to a healthy instance", []int{http.StatusInternalServerError, http.StatusNoContent}, false, true, http.StatusNoContent},
+		{"all instances failing", []int{http.StatusBadGateway, http.StatusInternalServerError}, false, false, http.StatusServiceUnavailable},
+		{"all instances failing with fail open", []int{http.StatusInternalServerError}, true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make([]*httptest.Server, 0, len(tt.statuses))
+			for _, status := range tt.statuses {
+				server := httptest.NewServer(handler(status))
+				defer server.Close()
+				servers = append(servers, server)
+			}
+			reg := &Registry{HealthPolicy: HealthPolicyPassing}
+			testAuthService(t, reg, servers...)
+			f := newForwardAuthorizer(reg, "http")
+			fa := &ForwardAuth{Service: "auth", ResponseHeaders: []string{"X-User"}, FailOpen: tt.failOpen}
+
+			req := httptest.NewRequest("POST", "/api/orders", nil)
+			decision := f.authorize(req, "orders", fa)
+			if decision.allow != tt.allow || decision.status != tt.status {
+				t.Fatalf("expected allow %v status %v, got %v %v", tt.allow, tt.status, decision.allow, decision.status)
+			}
+			if tt.allow && tt.status != 0 {
+				if decision.headers.Get("X-User") != "alice" || decision.headers.Get("X-Internal") != "" {
+					t.Fatalf("expected only the selected response headers, got %v", decision.headers)
+				}
+			}
+			if !tt.allow && tt.status < 500 && decision.body != "decision" {
+				t.Fatalf("expected the auth service body, got %q", decision.body)
+			}
+		})
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	testAuthService(t, reg, server)
+	f := newForwardAuthorizer(reg, "http")
+	fa := &ForwardAuth{Service: "auth", RequestHeaders: []string{"Authorization"}, CacheTTL: Duration{time.Minute}}
+
+	request := func(uri string, token string) *http.Request {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	tests := []struct {
+		name  string
+		req   *http.Request
+		allow bool
+		calls int32
+	}{
+		{"first request", request("/api/orders", "good"), true, 1},
+		{"cached", request("/api/orders", "good"), true, 1},
+		{"other credentials", request("/api/orders", "bad"), false, 2},
+		{"cached denial", request("/api/orders", "bad"), false, 2},
+		{"other uri", request("/api/orders/1", "good"), true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := f.authorize(tt.req, "orders", fa)
+			if decision.allow != tt.allow {
+				t.Fatalf("expected allow %v, got %v", tt.allow, decision.allow)
+			}
+			if n := atomic.LoadInt32(&calls); n != tt.calls {
+				t.Fatalf("expected %v auth calls, got %v", tt.calls, n)
+			}
+		})
+	}
+
+	// expired decisions are asked again
+	f.lock.Lock()
+	for key, decision := range f.cache {
+		decision.expires = time.Now().Add(-time.Second)
+		f.cache[key] = decision
+	}
+	f.lock.Unlock()
+	f.authorize(request("/api/orders", "good"), "orders", fa)
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("expected the expired decision to be asked again, got %v calls", n)
+	}
+}
@@ -0,0 +1,71 @@
+package xproxy
+
+import (
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// Health policies decide which endpoint states are routable
+const (
+	// HealthPolicyPassing routes only to endpoints with all checks passing
+	HealthPolicyPassing = "passing"
+	// HealthPolicyWarning routes to passing and warning endpoints
+	HealthPolicyWarning = "warning"
+	// HealthPolicyAny routes to all endpoints regardless of their checks
+	HealthPolicyAny = "any"
+)
+
+// healthStarting is the state of a new endpoint in its grace period whose checks haven't run yet
+const healthStarting = "starting"
+
+// checksCompleted returns false if a critical check has no output, meaning it has not run yet
+func checksCompleted(checks []*consul.HealthCheck) bool {
+	for _, check := range checks {
+		if check.Status == consul.HealthCritical && check.Output == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// healthState returns the instance state, a critical instance seen for less than the grace period
+// and without completed checks is reported as starting
+func (reg *Registry) healthState(instance xconsul.Instance, firstSeen time.Time, now time.Time) string {
+	if instance.Health == consul.HealthCritical && !checksCompleted(instance.Checks) && now.Sub(firstSeen) < reg.GracePeriod {
+		return healthStarting
+	}
+	return instance.Health
+}
+
+// routable returns true if the health policy allows traffic to an endpoint in the specified state
+func (reg *Registry) routable(state string) bool {
+	switch reg.HealthPolicy {
+	case HealthPolicyAny:
+		return true
+	case HealthPolicyWarning:
+		return state == consul.HealthPassing || state == consul.HealthWarning || state == healthStarting
+	}
+	return state == consul.HealthPassing || state == healthStarting
+}
+
+// scheduleGrace rebuilds the service when the earliest grace period of its starting endpoints ends,
+// so endpoints whose checks never completed leave the rotation on time. A zero end cancels the rebuild.
+// Must be called with the lock held.
+func (reg *Registry) scheduleGrace(service string, end time.Time, now time.Time) {
+	if timer, ok := reg.graceTimers[service]; ok {
+		timer.Stop()
+		delete(reg.graceTimers, service)
+	}
+	if end.IsZero() {
+		return
+	}
+	reg.graceTimers[service] = time.AfterFunc(end.Sub(now), func() {
+		reg.lock.Lock()
+		defer reg.lock.Unlock()
+		if entries, ok := reg.entries[service]; ok {
+			reg.apply(map[string]xconsul.Instances{service: entries}, nil, nil)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package xproxy
+
+// roleHolders returns the services holding the role, the slot holders when the elected
+// service holds a slot or else the elected service, must be called with the lock held
+func (reg *Registry) roleHolders(role string) []string {
+	leader, ok := reg.elections[role]
+	if !ok {
+		return nil
+	}
+	for _, service := range reg.holders[role] {
+		if service == leader {
+			return reg.holders[role]
+		}
+	}
+	return []string{leader}
+}
+
+// electedHolders returns the services holding each role, must be called with the lock held
+func (reg *Registry) electedHolders() map[string][]string {
+	holders := make(map[string][]string, len(reg.elections))
+	for role := range reg.elections {
+		holders[role] = reg.roleHolders(role)
+	}
+	return holders
+}
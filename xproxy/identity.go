@@ -0,0 +1,44 @@
+package xproxy
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stefanprodan/xmicro/xtoken"
+)
+
+// IdentityTokenHeader is the request header holding the identity token signed by the proxy
+const IdentityTokenHeader = "X-Identity-Token"
+
+// IdentitySigner attaches a short-lived token to upstream requests naming the calling service,
+// the route and the original client identity, signed with the active proxy key from the keyring.
+// The token audience is the service name the destination is registered as in the catalog.
+type IdentitySigner struct {
+	Service string
+	Keyring *xtoken.Keyring
+	TTL     time.Duration
+}
+
+// Inject replaces any client supplied identity token with one signed by the proxy
+func (s *IdentitySigner) Inject(req *http.Request, caller string, route Route, identity *Identity, destination string) {
+	req.Header.Del(IdentityTokenHeader)
+	key, ok := s.Keyring.SigningKey(s.Service)
+	if !ok {
+		log.Debugf("xproxy: no active signing key for %s, identity token not injected", s.Service)
+		return
+	}
+	claims := xtoken.NewClaims(xtoken.IdentityToken, s.Service, s.TTL)
+	claims.Caller = caller
+	claims.Route = route.Service + route.PathPrefix
+	claims.Audience = destination
+	if identity != nil {
+		claims.Subject = identity.Subject
+	}
+	token, err := xtoken.Sign(claims, key)
+	if err != nil {
+		log.Warnf("xproxy: identity token signing failed %s", err.Error())
+		return
+	}
+	req.Header.Set(IdentityTokenHeader, token)
+}
@@ -0,0 +1,56 @@
+package xproxy
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xtoken"
+)
+
+func testKeyring(t *testing.T, keys map[string]string) *xtoken.Keyring {
+	t.Helper()
+	keyring := xtoken.NewKeyring("xmicro/servicekeys/")
+	pairs := make(consul.KVPairs, 0, len(keys))
+	for id, value := range keys {
+		pairs = append(pairs, &consul.KVPair{Key: "xmicro/servicekeys/" + id, Value: []byte(value)})
+	}
+	keyring.Load(pairs)
+	return keyring
+}
+
+func TestIdentitySignerAudience(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	keyring := testKeyring(t, map[string]string{
+		"proxy-1": `{"alg":"HS256","service":"xproxy","active":true,"secret":"` + secret + `"}`,
+	})
+	signer := &IdentitySigner{Service: "xproxy", Keyring: keyring, TTL: time.Minute}
+
+	// names from containers-up.sh, the service xmicro-frontend runs with -role=frontend
+	tests := []struct {
+		name        string
+		destination string
+		audience    string
+		err         error
+	}{
+		{"registered service name", "xmicro-frontend", "xmicro-frontend", nil},
+		{"role is not the audience", "xmicro-frontend", "frontend", xtoken.ErrAudience},
+		{"other service", "xmicro-backend", "xmicro-frontend", xtoken.ErrAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://xmicro-proxy/"+tt.destination+"/", nil)
+			req.Header.Set(IdentityTokenHeader, "forged")
+			signer.Inject(req, "xmicro-backend", Route{Service: tt.destination, PathPrefix: "/"}, &Identity{Subject: "alice"}, tt.destination)
+			claims, err := xtoken.Verify(req.Header.Get(IdentityTokenHeader), keyring, xtoken.IdentityToken, tt.audience)
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && (claims.Service != "xproxy" || claims.Caller != "xmicro-backend" || claims.Subject != "alice") {
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
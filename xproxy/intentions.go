@@ -0,0 +1,221 @@
+package xproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	watch "github.com/hashicorp/consul/watch"
+	"github.com/stefanprodan/xmicro/xtoken"
+)
+
+// ServiceTokenHeader is the request header holding the signed token of the calling service,
+// only tokens of the service type issued for the destination service are accepted
+const ServiceTokenHeader = "X-Service-Token"
+
+// Intention allows or denies a source service to call a destination service, optionally scoped to methods and path prefixes.
+// Intentions are stored in Consul KV as JSON under the intentions key prefix, * matches any service.
+type Intention struct {
+	Name        string   `json:"name,omitempty"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Action      string   `json:"action"`
+	Methods     []string `json:"methods,omitempty"`
+	Paths       []string `json:"paths,omitempty"`
+}
+
+// precedence orders intentions from the most specific to the least specific, deny wins on ties
+func (i Intention) precedence() int {
+	p := 0
+	if i.Source != "*" {
+		p += 8
+	}
+	if i.Destination != "*" {
+		p += 4
+	}
+	if len(i.Paths) > 0 {
+		p += 2
+	}
+	if len(i.Methods) > 0 {
+		p++
+	}
+	p *= 2
+	if i.Action == "deny" {
+		p++
+	}
+	return p
+}
+
+func (i Intention) matches(source string, destination string, method string, path string) bool {
+	if i.Source != "*" && i.Source != source {
+		return false
+	}
+	if i.Destination != "*" && i.Destination != destination {
+		return false
+	}
+	if len(i.Methods) > 0 {
+		found := false
+		for _, m := range i.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(i.Paths) > 0 {
+		found := false
+		for _, p := range i.Paths {
+			if strings.HasPrefix(path, p) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Intentions enforces service to service authorization policies.
+// The source service is identified by the mTLS client certificate common name,
+// a signed service token or the registered service name of the client IP.
+type Intentions struct {
+	Prefix string
+	// Mode is enforce, audit (log denials without blocking) or off
+	Mode string
+	// DefaultAction applies when no intention matches, allow or deny
+	DefaultAction string
+	Keyring       *xtoken.Keyring
+	Registry      *Registry
+	intentions    []Intention
+	lock          sync.RWMutex
+	watch         *watch.WatchPlan
+}
+
+// StartSync loads the intentions from Consul KV and watches for changes
+func (in *Intentions) StartSync() error {
+	if in.Mode == "off" {
+		return nil
+	}
+	w, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": in.Prefix})
+	if err != nil {
+		return err
+	}
+	in.watch = w
+	w.Handler = func(idx uint64, data interface{}) {
+		pairs, _ := data.(consul.KVPairs)
+		in.Load(pairs)
+	}
+	config := consul.DefaultConfig()
+	go w.Run(config.Address)
+	return nil
+}
+
+// Load replaces the intentions with the ones decoded from the KV pairs, invalid intentions are skipped
+func (in *Intentions) Load(pairs consul.KVPairs) {
+	intentions := make([]Intention, 0)
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		var i Intention
+		if err := json.Unmarshal(pair.Value, &i); err != nil {
+			log.Warnf("xproxy: invalid intention %s %s", pair.Key, err.Error())
+			continue
+		}
+		if i.Source == "" || i.Destination == "" || (i.Action != "allow" && i.Action != "deny") {
+			log.Warnf("xproxy: invalid intention %s source, destination and action allow|deny are required", pair.Key)
+			continue
+		}
+		i.Name = strings.TrimPrefix(pair.Key, in.Prefix)
+		intentions = append(intentions, i)
+	}
+	sort.SliceStable(intentions, func(a, b int) bool {
+		return intentions[a].precedence() > intentions[b].precedence()
+	})
+	log.Infof("Intentions loaded, %v policies", len(intentions))
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.intentions = intentions
+}
+
+// All returns a copy of the intentions ordered by precedence
+func (in *Intentions) All() []Intention {
+	in.lock.RLock()
+	defer in.lock.RUnlock()
+	return append([]Intention{}, in.intentions...)
+}
+
+// Authorize identifies the source service and evaluates the intentions for the destination.
+// It returns the source service name, empty if unknown, and false if the request is denied.
+func (in *Intentions) Authorize(req *http.Request, destination string) (string, bool) {
+	source := in.identify(req, destination)
+	req.Header.Del(ServiceTokenHeader)
+	if in.Mode == "off" {
+		return source, true
+	}
+
+	in.lock.RLock()
+	action, name := in.DefaultAction, "default"
+	for _, i := range in.intentions {
+		if i.matches(source, destination, req.Method, req.URL.Path) {
+			action, name = i.Action, i.Name
+			break
+		}
+	}
+	in.lock.RUnlock()
+
+	if action == "allow" {
+		return source, true
+	}
+	if source == "" {
+		source = "unknown"
+	}
+	xproxy_intention_denials_total.WithLabelValues(source, destination, in.Mode).Inc()
+	if in.Mode == "audit" {
+		log.Warnf("xproxy: intention %s would deny %s to %s %s %s (audit mode)", name, source, destination, req.Method, req.URL.Path)
+		return source, true
+	}
+	log.Warnf("xproxy: intention %s denied %s to %s %s %s", name, source, destination, req.Method, req.URL.Path)
+	return source, false
+}
+
+// identify returns the calling service from the client certificate, the service token or the client IP
+func (in *Intentions) identify(req *http.Request, destination string) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		if cn := req.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	if token := req.Header.Get(ServiceTokenHeader); token != "" && in.Keyring != nil {
+		claims, err := xtoken.Verify(token, in.Keyring, xtoken.ServiceToken, destination)
+		if err == nil {
+			return claims.Service
+		}
+		log.Debugf("xproxy: invalid service token %s", err.Error())
+	}
+	if in.Registry != nil {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err == nil {
+			return in.Registry.ServiceByAddress(host)
+		}
+	}
+	return ""
+}
+
+// Stop stops the KV watcher
+func (in *Intentions) Stop() {
+	if in.watch != nil {
+		in.watch.Stop()
+	}
+}
@@ -0,0 +1,150 @@
+package xproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+	"github.com/stefanprodan/xmicro/xtoken"
+)
+
+func testIntentions(t *testing.T, mode string, defaultAction string, intentions map[string]Intention) *Intentions {
+	t.Helper()
+	in := &Intentions{Prefix: "xmicro/intentions/", Mode: mode, DefaultAction: defaultAction}
+	pairs := make(consul.KVPairs, 0, len(intentions))
+	for name, i := range intentions {
+		value, _ := json.Marshal(i)
+		pairs = append(pairs, &consul.KVPair{Key: in.Prefix + name, Value: value})
+	}
+	in.Load(pairs)
+	return in
+}
+
+func TestIntentionsPrecedence(t *testing.T) {
+	in := testIntentions(t, "enforce", "allow", map[string]Intention{
+		"deny-all-to-storage":     {Source: "*", Destination: "storage", Action: "deny"},
+		"backend-to-storage":      {Source: "backend", Destination: "storage", Action: "allow"},
+		"backend-storage-admin":   {Source: "backend", Destination: "storage", Action: "deny", Paths: []string{"/admin"}},
+		"backend-storage-read":    {Source: "backend", Destination: "storage", Action: "allow", Paths: []string{"/admin"}, Methods: []string{"GET"}},
+		"frontend-any":            {Source: "frontend", Destination: "*", Action: "deny"},
+		"frontend-backend-allow":  {Source: "frontend", Destination: "backend", Action: "allow"},
+		"frontend-backend-tie":    {Source: "frontend", Destination: "backend", Action: "deny", Methods: []string{"DELETE"}},
+		"frontend-backend-delete": {Source: "frontend", Destination: "backend", Action: "allow", Methods: []string{"DELETE"}},
+	})
+	tests := []struct {
+		name        string
+		source      string
+		destination string
+		method      string
+		path        string
+		allowed     bool
+	}{
+		{"wildcard source deny", "frontend", "storage", "GET", "/", false},
+		{"specific source beats wildcard", "backend", "storage", "GET", "/", true},
+		{"path scope beats unscoped", "backend", "storage", "POST", "/admin/keys", false},
+		{"method and path scope beats path scope", "backend", "storage", "GET", "/admin/keys", true},
+		{"specific destination beats wildcard", "frontend", "backend", "GET", "/", true},
+		{"deny wins a tie", "frontend", "backend", "DELETE", "/", false},
+		{"wildcard destination", "frontend", "storage", "GET", "/", false},
+		{"default action", "storage", "backend", "GET", "/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://xmicro-proxy"+tt.path, nil)
+			req.RemoteAddr = "192.168.1.1:40000"
+			in.Registry = testSourceRegistry(tt.source)
+			source, allowed := in.Authorize(req, tt.destination)
+			if source != tt.source || allowed != tt.allowed {
+				t.Fatalf("expected %s allowed %v, got %s %v", tt.source, tt.allowed, source, allowed)
+			}
+		})
+	}
+}
+
+// testSourceRegistry registers the source service at the 192.168.1.1 address
+func testSourceRegistry(source string) *Registry {
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.Replace("consul", map[string]xconsul.Instances{source: {{
+		ID: source, Service: source, Address: "192.168.1.1", Port: 8000, Health: consul.HealthPassing,
+	}}}, nil)
+	return reg
+}
+
+func TestIntentionsModes(t *testing.T) {
+	deny := map[string]Intention{"deny": {Source: "*", Destination: "storage", Action: "deny"}}
+	tests := []struct {
+		name          string
+		mode          string
+		defaultAction string
+		intentions    map[string]Intention
+		allowed       bool
+	}{
+		{"enforce", "enforce", "allow", deny, false},
+		{"audit", "audit", "allow", deny, true},
+		{"off", "off", "allow", deny, true},
+		{"default deny", "enforce", "deny", nil, false},
+		{"default allow", "enforce", "allow", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := testIntentions(t, tt.mode, tt.defaultAction, tt.intentions)
+			req := httptest.NewRequest("GET", "http://xmicro-proxy/", nil)
+			if _, allowed := in.Authorize(req, "storage"); allowed != tt.allowed {
+				t.Fatalf("expected allowed %v, got %v", tt.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestIntentionsServiceToken(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	keyring := testKeyring(t, map[string]string{
+		"backend-1": `{"alg":"HS256","service":"xmicro-backend","active":true,"secret":"` + secret + `"}`,
+	})
+	key, _ := keyring.SigningKey("xmicro-backend")
+	sign := func(typ string, service string, audience string, ttl time.Duration) string {
+		claims := xtoken.NewClaims(typ, service, ttl)
+		claims.Audience = audience
+		token, err := xtoken.Sign(claims, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	in := testIntentions(t, "enforce", "deny", map[string]Intention{
+		"backend-to-storage": {Source: "xmicro-backend", Destination: "xmicro-storage", Action: "allow"},
+	})
+	in.Keyring = keyring
+	tests := []struct {
+		name    string
+		token   string
+		source  string
+		allowed bool
+	}{
+		{"service token", sign(xtoken.ServiceToken, "xmicro-backend", "xmicro-storage", time.Minute), "xmicro-backend", true},
+		{"identity token replayed", sign(xtoken.IdentityToken, "xmicro-backend", "xmicro-storage", time.Minute), "unknown", false},
+		{"token for another destination", sign(xtoken.ServiceToken, "xmicro-backend", "xmicro-frontend", time.Minute), "unknown", false},
+		{"expired token", sign(xtoken.ServiceToken, "xmicro-backend", "xmicro-storage", -time.Minute), "unknown", false},
+		{"key bound to another service", sign(xtoken.ServiceToken, "xmicro-frontend", "xmicro-storage", time.Minute), "unknown", false},
+		{"no token", "", "unknown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://xmicro-proxy/", nil)
+			if tt.token != "" {
+				req.Header.Set(ServiceTokenHeader, tt.token)
+			}
+			source, allowed := in.Authorize(req, "xmicro-storage")
+			if source != tt.source || allowed != tt.allowed {
+				t.Fatalf("expected %q allowed %v, got %q %v", tt.source, tt.allowed, source, allowed)
+			}
+			if req.Header.Get(ServiceTokenHeader) != "" {
+				t.Fatal("expected the service token to be removed before proxying")
+			}
+		})
+	}
+}
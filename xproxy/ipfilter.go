@@ -0,0 +1,241 @@
+package xproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	watch "github.com/hashicorp/consul/watch"
+)
+
+const listenerContextKey = "listener"
+
+// PublicListener is the name of the listener exposed to clients outside the cluster
+const PublicListener = "public"
+
+// IPRule is a CIDR allow and deny list stored in Consul KV as JSON under the IP filter key prefix.
+// A rule without service applies globally, with service it applies to the service routes
+// and with path prefix to a single route. If listeners are set, the rule applies only to requests
+// received on those listeners, e.g. public.
+// The longest matching CIDR decides between allow and deny, deny wins on ties.
+// If none matches, a rule with only an allow list denies the request.
+type IPRule struct {
+	Name       string   `json:"name,omitempty"`
+	Service    string   `json:"service,omitempty"`
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	Listeners  []string `json:"listeners,omitempty"`
+	Allow      []string `json:"allow,omitempty"`
+	Deny       []string `json:"deny,omitempty"`
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+}
+
+func (r *IPRule) parse() error {
+	var err error
+	if r.allow, err = ParseCIDRs(r.Allow); err != nil {
+		return err
+	}
+	r.deny, err = ParseCIDRs(r.Deny)
+	return err
+}
+
+func (r IPRule) applies(listener string, service string, path string) bool {
+	if r.Service != "" && r.Service != service {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	if len(r.Listeners) > 0 {
+		for _, l := range r.Listeners {
+			if l == listener {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r IPRule) denies(ip net.IP) bool {
+	allowed := longestMatch(r.allow, ip)
+	denied := longestMatch(r.deny, ip)
+	if allowed < 0 && denied < 0 {
+		return len(r.allow) > 0 && len(r.deny) == 0
+	}
+	return denied >= allowed
+}
+
+// IPFilter evaluates the client IP against the global, service and route CIDR rules.
+// Requests received on the public listener are denied until the rules have loaded.
+type IPFilter struct {
+	Prefix string
+	// TrustedProxies are the networks allowed to set X-Forwarded-For
+	TrustedProxies []*net.IPNet
+	rules          []IPRule
+	loaded         bool
+	lock           sync.RWMutex
+	watch          *watch.WatchPlan
+}
+
+// StartSync loads the rules from Consul KV and watches for changes
+func (f *IPFilter) StartSync() error {
+	w, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": f.Prefix})
+	if err != nil {
+		return err
+	}
+	f.watch = w
+	w.Handler = func(idx uint64, data interface{}) {
+		pairs, _ := data.(consul.KVPairs)
+		f.Load(pairs)
+	}
+	config := consul.DefaultConfig()
+	go w.Run(config.Address)
+	return nil
+}
+
+// Load replaces the rules with the ones decoded from the KV pairs, invalid rules are skipped
+func (f *IPFilter) Load(pairs consul.KVPairs) {
+	rules := make([]IPRule, 0)
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		var rule IPRule
+		if err := json.Unmarshal(pair.Value, &rule); err != nil {
+			log.Warnf("xproxy: invalid IP rule %s %s", pair.Key, err.Error())
+			continue
+		}
+		if err := rule.parse(); err != nil {
+			log.Warnf("xproxy: invalid IP rule %s %s", pair.Key, err.Error())
+			continue
+		}
+		rule.Name = strings.TrimPrefix(pair.Key, f.Prefix)
+		rules = append(rules, rule)
+	}
+	log.Infof("IP rules loaded, %v rules", len(rules))
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rules = rules
+	f.loaded = true
+}
+
+// All returns a copy of the rules
+func (f *IPFilter) All() []IPRule {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return append([]IPRule{}, f.rules...)
+}
+
+// Allow evaluates the rules for the request, it returns false and the denying rule name if the client IP is blocked
+func (f *IPFilter) Allow(req *http.Request, service string, path string) (bool, string) {
+	ip := f.ClientIP(req)
+	if ip == nil {
+		return false, "invalid_ip"
+	}
+	listener := RequestListener(req)
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if !f.loaded && listener == PublicListener {
+		return false, "not_loaded"
+	}
+	for _, rule := range f.rules {
+		if rule.applies(listener, service, path) && rule.denies(ip) {
+			return false, rule.Name
+		}
+	}
+	return true, ""
+}
+
+// ClientIP returns the remote address, or the last untrusted X-Forwarded-For address if the peer is a trusted proxy
+func (f *IPFilter) ClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || longestMatch(f.TrustedProxies, ip) < 0 {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if longestMatch(f.TrustedProxies, hop) < 0 {
+			break
+		}
+	}
+	return ip
+}
+
+// Stop stops the KV watcher
+func (f *IPFilter) Stop() {
+	if f.watch != nil {
+		f.watch.Stop()
+	}
+}
+
+// ListenerMiddleware tags the requests with the name of the listener they were received on
+func ListenerMiddleware(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerContextKey, listener)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestListener returns the name of the listener the request was received on
+func RequestListener(req *http.Request) string {
+	listener, _ := req.Context().Value(listenerContextKey).(string)
+	return listener
+}
+
+// ParseCIDRs parses a list of CIDRs, single IPs are treated as /32 or /128 networks
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %s", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			value = fmt.Sprintf("%s/%v", value, bits)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// longestMatch returns the prefix length of the most specific network containing the IP, -1 if none
+func longestMatch(networks []*net.IPNet, ip net.IP) int {
+	longest := -1
+	for _, n := range networks {
+		if n.Contains(ip) {
+			if ones, _ := n.Mask.Size(); ones > longest {
+				longest = ones
+			}
+		}
+	}
+	return longest
+}
@@ -0,0 +1,148 @@
+package xproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func testIPFilter(t *testing.T, rules map[string]IPRule) *IPFilter {
+	t.Helper()
+	filter := &IPFilter{Prefix: "xmicro/ipfilter/"}
+	pairs := make(consul.KVPairs, 0, len(rules))
+	for name, rule := range rules {
+		value, err := json.Marshal(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, &consul.KVPair{Key: filter.Prefix + name, Value: value})
+	}
+	filter.Load(pairs)
+	return filter
+}
+
+func TestIPRuleDenies(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		ip     string
+		denied bool
+	}{
+		{"no match without allow list", nil, []string{"10.0.0.0/8"}, "192.168.1.1", false},
+		{"no match with only an allow list", []string{"10.0.0.0/8"}, nil, "192.168.1.1", true},
+		{"no match with allow and deny lists", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "192.168.1.1", false},
+		{"allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3", false},
+		{"denied", nil, []string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{"longer allow wins", []string{"10.1.2.0/24"}, []string{"10.0.0.0/8"}, "10.1.2.3", false},
+		{"longer deny wins", []string{"10.0.0.0/8"}, []string{"10.1.2.0/24"}, "10.1.2.3", true},
+		{"deny wins ties", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{"single IP", []string{"10.0.0.0/8"}, []string{"10.1.2.3"}, "10.1.2.3", true},
+		{"IPv6", []string{"fd00::/8"}, nil, "fd00::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := IPRule{Allow: tt.allow, Deny: tt.deny}
+			if err := rule.parse(); err != nil {
+				t.Fatal(err)
+			}
+			if denied := rule.denies(net.ParseIP(tt.ip)); denied != tt.denied {
+				t.Fatalf("expected %v, got %v", tt.denied, denied)
+			}
+		})
+	}
+}
+
+func TestIPFilterAllow(t *testing.T) {
+	filter := testIPFilter(t, map[string]IPRule{
+		"global":  {Deny: []string{"203.0.113.0/24"}},
+		"backend": {Service: "xmicro-backend", Allow: []string{"10.0.0.0/8"}},
+		"admin":   {Service: "xmicro-frontend", PathPrefix: "/admin", Deny: []string{"0.0.0.0/0"}},
+		"public":  {Listeners: []string{PublicListener}, Deny: []string{"198.51.100.0/24"}},
+		"invalid": {Deny: []string{"10.0.0.0/33"}},
+	})
+	tests := []struct {
+		name     string
+		listener string
+		remote   string
+		service  string
+		path     string
+		allowed  bool
+		rule     string
+	}{
+		{"global deny", "", "203.0.113.1:1234", "xmicro-frontend", "/", false, "global"},
+		{"service allow list", "", "192.168.1.1:1234", "xmicro-backend", "/", false, "backend"},
+		{"service allowed", "", "10.0.0.1:1234", "xmicro-backend", "/", true, ""},
+		{"other service", "", "192.168.1.1:1234", "xmicro-frontend", "/", true, ""},
+		{"route deny", "", "10.0.0.1:1234", "xmicro-frontend", "/admin/users", false, "admin"},
+		{"other route", "", "10.0.0.1:1234", "xmicro-frontend", "/users", true, ""},
+		{"listener rule", PublicListener, "198.51.100.1:1234", "xmicro-frontend", "/", false, "public"},
+		{"other listener", "internal", "198.51.100.1:1234", "xmicro-frontend", "/", true, ""},
+		{"invalid remote address", "", "unknown", "xmicro-frontend", "/", false, "invalid_ip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = tt.remote
+			if tt.listener != "" {
+				req = req.WithContext(context.WithValue(req.Context(), listenerContextKey, tt.listener))
+			}
+			allowed, rule := filter.Allow(req, tt.service, tt.path)
+			if allowed != tt.allowed || rule != tt.rule {
+				t.Fatalf("expected %v %s, got %v %s", tt.allowed, tt.rule, allowed, rule)
+			}
+		})
+	}
+	if rules := filter.All(); len(rules) != 4 {
+		t.Fatalf("expected the invalid rule to be skipped, got %v rules", len(rules))
+	}
+}
+
+func TestIPFilterNotLoaded(t *testing.T) {
+	filter := &IPFilter{}
+	req := httptest.NewRequest("GET", "/", nil)
+	if allowed, _ := filter.Allow(req, "xmicro-frontend", "/"); !allowed {
+		t.Fatal("expected internal requests to be allowed before the rules load")
+	}
+	req = req.WithContext(context.WithValue(req.Context(), listenerContextKey, PublicListener))
+	if allowed, rule := filter.Allow(req, "xmicro-frontend", "/"); allowed || rule != "not_loaded" {
+		t.Fatalf("expected public requests to be denied, got %v %s", allowed, rule)
+	}
+}
+
+func TestIPFilterClientIP(t *testing.T) {
+	trusted, _ := ParseCIDRs([]string{"10.0.0.0/8", "172.16.0.1"})
+	filter := &IPFilter{TrustedProxies: trusted}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{"direct", "192.168.1.1:1234", nil, "192.168.1.1"},
+		{"untrusted peer", "192.168.1.1:1234", []string{"203.0.113.1"}, "192.168.1.1"},
+		{"trusted peer", "10.0.0.1:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"trusted peer without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"203.0.113.1, 172.16.0.1", "10.0.0.2"}, "203.0.113.1"},
+		{"spoofed hops before the client", "10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.1"}, "203.0.113.1"},
+		{"malformed hop", "10.0.0.1:1234", []string{"203.0.113.1, unknown"}, "10.0.0.1"},
+		{"all hops trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"remote without port", "10.0.0.1", []string{"203.0.113.1"}, "203.0.113.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if ip := filter.ClientIP(req); ip.String() != tt.ip {
+				t.Fatalf("expected %s, got %s", tt.ip, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package xproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// minimum interval between two JWKS reloads triggered by unknown key ids
+const jwksMissRefreshInterval = 30 * time.Second
+
+// max size of a JWKS fetched over HTTP
+const jwksMaxBytes = 1 << 20
+
+// jsonWebKey is a RSA, EC P-256 or symmetric key as defined by RFC 7517
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// verificationKey is a decoded JSON web key
+type verificationKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// JWKS caches the JSON web key set loaded from a file or URL and reloads it periodically to pick up rotated keys
+type JWKS struct {
+	Source          string
+	RefreshInterval time.Duration
+	keys            []verificationKey
+	lastLoad        time.Time
+	// lastMiss is the time of the last reload triggered by an unknown key id, guarded by loadLock
+	lastMiss time.Time
+	lock     sync.RWMutex
+	loadLock sync.Mutex
+	stopChan chan struct{}
+}
+
+// NewJWKS loads the key set from source, a file path or a http(s) URL, and starts the refresh loop
+func NewJWKS(source string, refreshInterval time.Duration) (*JWKS, error) {
+	j := &JWKS{
+		Source:          source,
+		RefreshInterval: refreshInterval,
+		stopChan:        make(chan struct{}),
+	}
+	if err := j.Load(); err != nil {
+		return nil, err
+	}
+	if refreshInterval > 0 {
+		go j.refresh()
+	}
+	return j, nil
+}
+
+// Load fetches and decodes the key set, on error the cached keys are kept
+func (j *JWKS) Load() error {
+	j.loadLock.Lock()
+	defer j.loadLock.Unlock()
+	return j.load()
+}
+
+func (j *JWKS) load() error {
+	data, err := j.fetch()
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("xproxy: invalid JWKS %s %s", j.Source, err.Error())
+	}
+	keys := make([]verificationKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.decode()
+		if err != nil {
+			log.Warnf("xproxy: skipping JWKS key %s %s", jwk.Kid, err.Error())
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != key.alg {
+			log.Warnf("xproxy: skipping JWKS key %s unsupported algorithm %s", jwk.Kid, jwk.Alg)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.keys = keys
+	j.lastLoad = time.Now()
+	return nil
+}
+
+// Stop ends the refresh loop
+func (j *JWKS) Stop() {
+	close(j.stopChan)
+}
+
+// lookup returns the keys matching the key id and algorithm,
+// an unknown key id triggers a rate limited reload to handle key rotation
+func (j *JWKS) lookup(kid string, alg string) []verificationKey {
+	keys := j.match(kid, alg)
+	if len(keys) == 0 && kid != "" {
+		// match again even if this call did not reload, a concurrent miss may have
+		j.reloadMiss()
+		keys = j.match(kid, alg)
+	}
+	return keys
+}
+
+// reloadMiss reloads the key set unless it was loaded or a miss reload was attempted within the miss
+// refresh interval, failed reloads count too
+func (j *JWKS) reloadMiss() {
+	j.loadLock.Lock()
+	defer j.loadLock.Unlock()
+	// re-check under loadLock, a concurrent miss may have reloaded the keys already
+	j.lock.RLock()
+	lastLoad := j.lastLoad
+	j.lock.RUnlock()
+	if time.Since(lastLoad) < jwksMissRefreshInterval || time.Since(j.lastMiss) < jwksMissRefreshInterval {
+		return
+	}
+	j.lastMiss = time.Now()
+	if err := j.load(); err != nil {
+		log.Warnf("xproxy: JWKS reload failed %s", err.Error())
+	}
+}
+
+func (j *JWKS) match(kid string, alg string) []verificationKey {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	keys := make([]verificationKey, 0)
+	for _, k := range j.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	if !strings.HasPrefix(j.Source, "http://") && !strings.HasPrefix(j.Source, "https://") {
+		return ioutil.ReadFile(j.Source)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(j.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("xproxy: JWKS %s returned status %v", j.Source, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > jwksMaxBytes {
+		return nil, fmt.Errorf("xproxy: JWKS %s is larger than %v bytes", j.Source, jwksMaxBytes)
+	}
+	return data, nil
+}
+
+func (j *JWKS) refresh() {
+	ticker := time.NewTicker(j.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stopChan:
+			return
+		case <-ticker.C:
+			if err := j.Load(); err != nil {
+				log.Warnf("xproxy: JWKS refresh failed %s", err.Error())
+			}
+		}
+	}
+}
+
+// decode converts the JSON web key into a RSA, ECDSA or HMAC key, the algorithm is derived from the key type
+func (jwk jsonWebKey) decode() (verificationKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		return verificationKey{kid: jwk.Kid, alg: "RS256", key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return verificationKey{}, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return verificationKey{}, errors.New("point is not on curve P-256")
+		}
+		return verificationKey{kid: jwk.Kid, alg: "ES256", key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(k) == 0 {
+			return verificationKey{}, errors.New("invalid symmetric key")
+		}
+		return verificationKey{kid: jwk.Kid, alg: "HS256", key: k}, nil
+	}
+	return verificationKey{}, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,93 @@
+package xproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWKSKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	old, rotated, next := newTestKeys(t), newTestKeys(t), newTestKeys(t)
+	writeJWKS(t, path, old.jwks("2024-01", "", ""))
+	jwks, err := NewJWKS(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Unix() + 60}
+
+	// the new key is published while the keys were loaded recently, the miss reload is rate limited
+	writeJWKS(t, path, rotated.jwks("2024-02", "", ""))
+	if _, err := verifyJWT(rotated.sign(t, "RS256", "2024-02", claims), jwks, "", ""); err != errTokenKey {
+		t.Fatalf("expected the unknown key to wait for the miss interval, got %v", err)
+	}
+
+	// once the interval passed an unknown key id reloads the set
+	jwks.lock.Lock()
+	jwks.lastLoad = time.Now().Add(-2 * jwksMissRefreshInterval)
+	jwks.lock.Unlock()
+	if _, err := verifyJWT(rotated.sign(t, "RS256", "2024-02", claims), jwks, "", ""); err != nil {
+		t.Fatalf("expected the rotated key to be loaded, got %v", err)
+	}
+	if _, err := verifyJWT(old.sign(t, "RS256", "2024-01", claims), jwks, "", ""); err != errTokenKey {
+		t.Fatalf("expected the removed key to be rejected, got %v", err)
+	}
+
+	// a second miss within the interval doesn't reload even if the keys are old
+	writeJWKS(t, path, next.jwks("2024-03", "", ""))
+	jwks.lock.Lock()
+	jwks.lastLoad = time.Now().Add(-2 * jwksMissRefreshInterval)
+	jwks.lock.Unlock()
+	if _, err := verifyJWT(next.sign(t, "RS256", "2024-03", claims), jwks, "", ""); err != errTokenKey {
+		t.Fatalf("expected the miss reload to be rate limited, got %v", err)
+	}
+
+	// a scheduled load picks up the key
+	if err := jwks.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyJWT(next.sign(t, "RS256", "2024-03", claims), jwks, "", ""); err != nil {
+		t.Fatalf("expected the reloaded key to verify, got %v", err)
+	}
+}
+
+func TestJWKSFetch(t *testing.T) {
+	keys := newTestKeys(t)
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+		loaded bool
+	}{
+		{"key set", http.StatusOK, keys.jwks("rsa-1", "ec-1", ""), true},
+		{"error status", http.StatusInternalServerError, keys.jwks("rsa-1", "", ""), false},
+		{"over the size limit", http.StatusOK, []byte(`{"keys":[],"pad":"` + strings.Repeat("x", jwksMaxBytes) + `"}`), false},
+		{"invalid json", http.StatusOK, []byte("keys"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+			jwks, err := NewJWKS(server.URL, 0)
+			if (err == nil) != tt.loaded {
+				t.Fatalf("expected loaded %v, got %v", tt.loaded, err)
+			}
+			if tt.loaded && len(jwks.match("ec-1", "ES256")) != 1 {
+				t.Fatal("expected the EC key to be loaded")
+			}
+		})
+	}
+}
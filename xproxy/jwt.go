@@ -0,0 +1,154 @@
+package xproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clock skew tolerated when validating exp and nbf
+const jwtLeeway = 30 * time.Second
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenAlg       = errors.New("unsupported token algorithm")
+	errTokenKey       = errors.New("no key found for token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+	errTokenNoExpiry  = errors.New("token has no expiry")
+	errTokenNotBefore = errors.New("token not valid yet")
+	errTokenIssuer    = errors.New("invalid token issuer")
+	errTokenAudience  = errors.New("invalid token audience")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyJWT checks the token signature against the key set and validates the registered claims
+func verifyJWT(token string, keys *JWKS, issuer string, audience string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" && header.Alg != "HS256" {
+		return nil, errTokenAlg
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	candidates := keys.lookup(header.Kid, header.Alg)
+	if len(candidates) == 0 {
+		return nil, errTokenKey
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, k := range candidates {
+		if verifySignature(header.Alg, k.key, parts[0]+"."+parts[1], digest[:], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errTokenSignature
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errTokenMalformed
+	}
+	if err := validateClaims(claims, issuer, audience); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key interface{}, signed string, digest []byte, signature []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return false
+}
+
+// validateClaims checks the expiry, which is required, the not before time and, if set, the issuer and audience
+func validateClaims(claims map[string]interface{}, issuer string, audience string) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errTokenNoExpiry
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+			return errTokenNotBefore
+		}
+	}
+	if issuer != "" && claims["iss"] != issuer {
+		return errTokenIssuer
+	}
+	if audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud != audience {
+				return errTokenAudience
+			}
+		case []interface{}:
+			found := false
+			for _, a := range aud {
+				if a == audience {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errTokenAudience
+			}
+		default:
+			return errTokenAudience
+		}
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,162 @@
+package xproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKeys are the private keys matching the public keys of the test key set
+type testKeys struct {
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	secret []byte
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey, secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwks returns the public key set with the RSA, EC and symmetric keys under the key ids
+func (k testKeys) jwks(rsaKid string, ecKid string, octKid string) []byte {
+	keys := make([]jsonWebKey, 0)
+	if rsaKid != "" {
+		keys = append(keys, jsonWebKey{Kid: rsaKid, Kty: "RSA", Use: "sig",
+			N: b64(k.rsa.N.Bytes()), E: b64(big.NewInt(int64(k.rsa.E)).Bytes())})
+	}
+	if ecKid != "" {
+		keys = append(keys, jsonWebKey{Kid: ecKid, Kty: "EC", Crv: "P-256",
+			X: b64(k.ec.X.Bytes()), Y: b64(k.ec.Y.Bytes())})
+	}
+	if octKid != "" {
+		keys = append(keys, jsonWebKey{Kid: octKid, Kty: "oct", K: b64(k.secret)})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return data
+}
+
+// sign returns a compact JWT signed with the key of the algorithm
+func (k testKeys) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		s, err := rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = s
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + b64(signature)
+}
+
+// writeJWKS writes the key set to the file
+func writeJWKS(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	keys := newTestKeys(t)
+	writeJWKS(t, path, keys.jwks("rsa-1", "ec-1", "oct-1"))
+	jwks, err := NewJWKS(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "alice", "iss": "https://idp", "aud": "xmicro", "exp": now + 60}
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+				continue
+			}
+			claims[k] = v
+		}
+		return claims
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa-1", valid(nil)), nil},
+		{"ES256", keys.sign(t, "ES256", "ec-1", valid(nil)), nil},
+		{"HS256", keys.sign(t, "HS256", "oct-1", valid(nil)), nil},
+		{"no key id", keys.sign(t, "RS256", "", valid(nil)), nil},
+		{"audience list", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"aud": []string{"other", "xmicro"}})), nil},
+		{"expiry within leeway", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"exp": now - 10})), nil},
+		{"expired", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"exp": now - 3600})), errTokenExpired},
+		{"no expiry", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"exp": nil})), errTokenNoExpiry},
+		{"not valid yet", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"nbf": now + 3600})), errTokenNotBefore},
+		{"other issuer", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"iss": "https://evil"})), errTokenIssuer},
+		{"other audience", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"aud": "other"})), errTokenAudience},
+		{"no audience", keys.sign(t, "RS256", "rsa-1", valid(map[string]interface{}{"aud": nil})), errTokenAudience},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"exp":9999999999}`)) + ".", errTokenAlg},
+		{"key id of another algorithm", keys.sign(t, "HS256", "rsa-1", valid(nil)), errTokenKey},
+		{"signed by another key", newTestKeys(t).sign(t, "ES256", "ec-1", valid(nil)), errTokenSignature},
+		{"malformed", "not.a.token", errTokenMalformed},
+		{"two segments", "header.payload", errTokenMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyJWT(tt.token, jwks, "https://idp", "xmicro")
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && claims["sub"] != "alice" {
+				t.Fatalf("expected the subject claim, got %v", claims)
+			}
+		})
+	}
+}
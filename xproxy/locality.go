@@ -0,0 +1,165 @@
+package xproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// Locality prefers the upstream endpoints on the proxy node, then the ones in the proxy zone.
+// Traffic spills over to the zone when the routable fraction of the node endpoints falls below the
+// spillover threshold, and to the other zones when the routable fraction of the zone endpoints does,
+// the endpoints of every zone are then picked in proportion to the zone weight.
+type Locality struct {
+	// Node is the Consul node of the proxy, the local agent node if empty
+	Node string
+	// Zone of the proxy, read from the node meta of the local agent if empty
+	Zone string
+	// ZoneKey is the node meta key holding the zone, service meta is used as fallback
+	ZoneKey string
+	// SpilloverThreshold is the minimum routable fraction of the node and of the zone endpoints
+	SpilloverThreshold float64
+	// Weights of the zones, 1 if not set
+	Weights map[string]float64
+}
+
+// ParseZoneWeights parses the zone weights, format: zone=weight,zone=weight
+func ParseZoneWeights(value string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid zone weight %s, format: zone=weight", pair)
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid zone weight %s, format: zone=weight", pair)
+		}
+		weights[parts[0]] = weight
+	}
+	return weights, nil
+}
+
+// Resolve reads the node and zone of the local Consul agent when not set
+func (l *Locality) Resolve() error {
+	if l.Node != "" && l.Zone != "" {
+		return nil
+	}
+	client, err := consul.NewClient(consul.DefaultConfig())
+	if err != nil {
+		return err
+	}
+	node, meta, err := xconsul.NewCatalog(client, "").Node()
+	if l.Node == "" {
+		l.Node = node
+	}
+	if l.Zone == "" {
+		l.Zone = meta[l.ZoneKey]
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("xproxy: locality node %s zone %s", l.Node, l.Zone)
+	return nil
+}
+
+// zone returns the zone of the instance
+func (l *Locality) zone(instance xconsul.Instance) string {
+	if zone, ok := instance.NodeMeta[l.ZoneKey]; ok {
+		return zone
+	}
+	return instance.Meta[l.ZoneKey]
+}
+
+// weight returns the weight of the zone
+func (l *Locality) weight(zone string) float64 {
+	if w, ok := l.Weights[zone]; ok {
+		return w
+	}
+	return 1
+}
+
+// pick returns one of the routable endpoints of the service subset, a random one if locality is not set
+func (l *Locality) pick(s *Snapshot, service string, subset *Subset, endpoints []string) string {
+	if len(endpoints) == 1 {
+		return endpoints[0]
+	}
+	if l == nil {
+		return endpoints[rand.Intn(len(endpoints))]
+	}
+	node := make([]string, 0)
+	zone := make([]string, 0)
+	for _, endpoint := range endpoints {
+		instance, ok := s.endpoints[endpoint]
+		if !ok {
+			continue
+		}
+		if l.Node != "" && instance.Node == l.Node {
+			node = append(node, endpoint)
+		}
+		if l.Zone != "" && l.zone(instance) == l.Zone {
+			zone = append(zone, endpoint)
+		}
+	}
+	onNode := func(instance xconsul.Instance) bool { return instance.Node == l.Node }
+	if len(node) > 0 && !l.spillover(s, service, subset, len(node), onNode) {
+		return node[rand.Intn(len(node))]
+	}
+	inZone := func(instance xconsul.Instance) bool { return l.zone(instance) == l.Zone }
+	if len(zone) > 0 && !l.spillover(s, service, subset, len(zone), inZone) {
+		return zone[rand.Intn(len(zone))]
+	}
+	if l.Zone != "" {
+		xproxy_locality_spillover_total.WithLabelValues(service).Inc()
+	}
+	return l.weighted(s, endpoints)
+}
+
+// spillover returns true if the routable fraction of the node or zone endpoints of the service subset,
+// the ones matching local, is below the threshold
+func (l *Locality) spillover(s *Snapshot, service string, subset *Subset, routable int, local func(xconsul.Instance) bool) bool {
+	total := 0
+	for endpoint := range s.Health[service] {
+		if instance, ok := s.endpoints[endpoint]; ok && local(instance) && subset.selects(instance) {
+			total++
+		}
+	}
+	return total > 0 && float64(routable)/float64(total) < l.SpilloverThreshold
+}
+
+// weighted returns an endpoint picked in proportion to the weight of its zone, the zone weight is split
+// evenly across its endpoints so a zone gets its share of the traffic whatever its number of endpoints
+func (l *Locality) weighted(s *Snapshot, endpoints []string) string {
+	zones := make([]string, len(endpoints))
+	counts := make(map[string]int)
+	for n, endpoint := range endpoints {
+		zones[n] = l.zone(s.endpoints[endpoint])
+		counts[zones[n]]++
+	}
+	weights := make([]float64, len(endpoints))
+	sum := 0.0
+	for n, zone := range zones {
+		weights[n] = l.weight(zone) / float64(counts[zone])
+		sum += weights[n]
+	}
+	if sum <= 0 {
+		return endpoints[rand.Intn(len(endpoints))]
+	}
+	r := rand.Float64() * sum
+	for n, w := range weights {
+		if r < w {
+			return endpoints[n]
+		}
+		r -= w
+	}
+	return endpoints[len(endpoints)-1]
+}
@@ -0,0 +1,145 @@
+package xproxy
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// testLocalityRegistry registers 3 api instances in zone a, 2 of them on node n1, and 3 in zone b.
+// The critical instances are not routable, the instances with a tag are tagged v2.
+func testLocalityRegistry(critical []int, tagged []int) *Registry {
+	instances := testInstances("api", 6)
+	nodes := []string{"n1", "n1", "n2", "n3", "n3", "n4"}
+	zones := []string{"a", "a", "a", "b", "b", "b"}
+	for n := range instances {
+		instances[n].Node = nodes[n]
+		instances[n].NodeMeta = map[string]string{"zone": zones[n]}
+	}
+	for _, n := range critical {
+		instances[n].Health = consul.HealthCritical
+	}
+	for _, n := range tagged {
+		instances[n].Tags = []string{"v2"}
+	}
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.Replace("consul", map[string]xconsul.Instances{"api": instances}, nil)
+	return reg
+}
+
+func TestLocalityPick(t *testing.T) {
+	v2 := &Subset{Name: "v2", Tags: []string{"v2"}}
+	tests := []struct {
+		name      string
+		threshold float64
+		critical  []int
+		subset    *Subset
+		tagged    []int
+		expected  []string
+	}{
+		{"node", 0.5, nil, nil, nil, []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+		{"node at threshold", 0.5, []int{0}, nil, nil, []string{"10.0.0.2:8080"}},
+		{"node spillover to zone", 0.6, []int{0}, nil, nil, []string{"10.0.0.2:8080", "10.0.0.3:8080"}},
+		{"node down", 0.3, []int{0, 1}, nil, nil, []string{"10.0.0.3:8080"}},
+		{"zone spillover", 0.5, []int{0, 1}, nil, nil, []string{"10.0.0.3:8080", "10.0.0.4:8080", "10.0.0.5:8080", "10.0.0.6:8080"}},
+		{"zone down", 0.5, []int{0, 1, 2}, nil, nil, []string{"10.0.0.4:8080", "10.0.0.5:8080", "10.0.0.6:8080"}},
+		{"subset node", 0.6, []int{0}, v2, []int{1, 3}, []string{"10.0.0.2:8080"}},
+		{"subset zone spillover", 0.6, []int{1}, v2, []int{1, 2, 3}, []string{"10.0.0.3:8080", "10.0.0.4:8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := testLocalityRegistry(tt.critical, tt.tagged).Snapshot()
+			endpoints, _ := snapshot.Lookup("api")
+			if tt.subset != nil {
+				endpoints, _ = snapshot.LookupSubset("api", *tt.subset)
+			}
+			locality := &Locality{Node: "n1", Zone: "a", ZoneKey: "zone", SpilloverThreshold: tt.threshold}
+			picked := make(map[string]bool)
+			for i := 0; i < 500; i++ {
+				picked[locality.pick(snapshot, "api", tt.subset, endpoints)] = true
+			}
+			result := make([]string, 0, len(picked))
+			for endpoint := range picked {
+				result = append(result, endpoint)
+			}
+			sort.Strings(result)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestLocalityPickWithoutLocality(t *testing.T) {
+	snapshot := testLocalityRegistry(nil, nil).Snapshot()
+	endpoints, _ := snapshot.Lookup("api")
+	var locality *Locality
+	picked := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		picked[locality.pick(snapshot, "api", nil, endpoints)] = true
+	}
+	if len(picked) != len(endpoints) {
+		t.Fatalf("expected all %v endpoints to be picked, got %v", len(endpoints), picked)
+	}
+}
+
+func TestLocalityWeighted(t *testing.T) {
+	snapshot := testLocalityRegistry(nil, nil).Snapshot()
+	// zone a has three endpoints and zone b one
+	endpoints := []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		share   float64
+	}{
+		{"equal weights", nil, 0.5},
+		{"weighted", map[string]float64{"a": 3, "b": 1}, 0.75},
+		{"zone drained", map[string]float64{"a": 0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locality := &Locality{ZoneKey: "zone", Weights: tt.weights}
+			picks := 10000
+			zoneA := 0
+			for i := 0; i < picks; i++ {
+				if locality.zone(snapshot.endpoints[locality.weighted(snapshot, endpoints)]) == "a" {
+					zoneA++
+				}
+			}
+			if share := float64(zoneA) / float64(picks); math.Abs(share-tt.share) > 0.03 {
+				t.Fatalf("expected zone a share %v, got %v", tt.share, share)
+			}
+		})
+	}
+}
+
+func TestParseZoneWeights(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected map[string]float64
+		valid    bool
+	}{
+		{"empty", "", map[string]float64{}, true},
+		{"weights", "a=2, b=0.5,", map[string]float64{"a": 2, "b": 0.5}, true},
+		{"no weight", "a", nil, false},
+		{"no zone", "=1", nil, false},
+		{"negative", "a=-1", nil, false},
+		{"not a number", "a=x", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weights, err := ParseZoneWeights(tt.value)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, err)
+			}
+			if tt.valid && !reflect.DeepEqual(weights, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, weights)
+			}
+		})
+	}
+}
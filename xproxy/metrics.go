@@ -11,7 +11,7 @@ var xproxy_roundtrips_total = prometheus.NewCounterVec(
 		Name:      "roundtrips_total",
 		Help:      "The total number of xproxy round trips.",
 	},
-	[]string{"service", "status"},
+	[]string{"service", "datacenter", "status"},
 )
 
 var xproxy_roundtrips_latency = prometheus.NewSummaryVec(
@@ -21,6 +21,56 @@ var xproxy_roundtrips_latency = prometheus.NewSummaryVec(
 		Name:      "roundtrips_latency",
 		Help:      "The latency of xproxy round trips.",
 	},
+	[]string{"service", "datacenter"},
+)
+
+var xproxy_auth_failures_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "x",
+		Subsystem: "proxy",
+		Name:      "auth_failures_total",
+		Help:      "The total number of requests rejected by xproxy authentication.",
+	},
+	[]string{"service"},
+)
+
+var xproxy_forward_auth_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "x",
+		Subsystem: "proxy",
+		Name:      "forward_auth_total",
+		Help:      "The total number of xproxy forward auth decisions.",
+	},
+	[]string{"service", "result"},
+)
+
+var xproxy_intention_denials_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "x",
+		Subsystem: "proxy",
+		Name:      "intention_denials_total",
+		Help:      "The total number of requests denied by xproxy intentions.",
+	},
+	[]string{"source", "destination", "mode"},
+)
+
+var xproxy_ipfilter_denials_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "x",
+		Subsystem: "proxy",
+		Name:      "ipfilter_denials_total",
+		Help:      "The total number of requests denied by xproxy IP rules.",
+	},
+	[]string{"rule"},
+)
+
+var xproxy_locality_spillover_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "x",
+		Subsystem: "proxy",
+		Name:      "locality_spillover_total",
+		Help:      "The total number of xproxy requests routed outside the proxy zone.",
+	},
 	[]string{"service"},
 )
 
@@ -28,4 +78,38 @@ var xproxy_roundtrips_latency = prometheus.NewSummaryVec(
 func RegisterMetrics() {
 	prometheus.MustRegister(xproxy_roundtrips_total)
 	prometheus.MustRegister(xproxy_roundtrips_latency)
+	prometheus.MustRegister(xproxy_auth_failures_total)
+	prometheus.MustRegister(xproxy_forward_auth_total)
+	prometheus.MustRegister(xproxy_intention_denials_total)
+	prometheus.MustRegister(xproxy_ipfilter_denials_total)
+	prometheus.MustRegister(xproxy_locality_spillover_total)
+}
+
+// RegisterMetrics exposes the age and stale state of the registry snapshot
+func (reg *Registry) RegisterMetrics() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "x",
+			Subsystem: "proxy",
+			Name:      "registry_snapshot_age_seconds",
+			Help:      "The time elapsed since the xproxy registry was last synced with a discovery backend.",
+		},
+		func() float64 {
+			return reg.Snapshot().Age().Seconds()
+		},
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "x",
+			Subsystem: "proxy",
+			Name:      "registry_snapshot_stale",
+			Help:      "1 while xproxy serves the registry snapshot loaded from disk.",
+		},
+		func() float64 {
+			if reg.Snapshot().Stale {
+				return 1
+			}
+			return 0
+		},
+	))
 }
@@ -0,0 +1,132 @@
+package xproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// snapshotSource is the registry source name of the snapshot loaded from disk
+const snapshotSource = "snapshot"
+
+// Age returns the time elapsed since the last update received from a discovery backend
+func (s *Snapshot) Age() time.Duration {
+	if s.Synced.IsZero() {
+		return 0
+	}
+	return time.Since(s.Synced)
+}
+
+// LoadSnapshot loads the last persisted snapshot, including the leader mappings.
+// The snapshot is served marked as stale until every discovery backend has done a full sync.
+func (reg *Registry) LoadSnapshot(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.init()
+	if reg.synced.After(snapshot.Synced) {
+		// a backend synced already, the snapshot on disk is older
+		return nil
+	}
+	if snapshot.Version > reg.version {
+		reg.version = snapshot.Version
+	}
+	reg.synced = snapshot.Synced
+	reg.stale = true
+	reg.holders = snapshot.Holders
+	reg.tokens = snapshot.Tokens
+	reg.update(snapshotSource, snapshot.Instances, nil, snapshot.Leaders)
+	log.Warnf("Registry snapshot loaded from %s, serving %v services synced %v ago until the first sync",
+		path, len(snapshot.Instances), snapshot.Age().Round(time.Second))
+	return nil
+}
+
+// SetBackends sets the names of the discovery backends feeding the registry, the snapshot loaded from disk
+// is served until each of them has done a full sync. If not set, the first full sync replaces the snapshot.
+func (reg *Registry) SetBackends(names []string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.backends = names
+}
+
+// backendsSynced returns true if every discovery backend has done a full sync, must be called with the lock held
+func (reg *Registry) backendsSynced() bool {
+	if len(reg.backends) == 0 {
+		return true
+	}
+	for _, name := range reg.backends {
+		if !reg.fullSynced[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// StartPersistence writes every new snapshot to the path, at most once per interval.
+// Stale snapshots are not written back.
+func (reg *Registry) StartPersistence(path string, interval time.Duration) {
+	reg.lock.Lock()
+	if reg.persist != nil {
+		reg.lock.Unlock()
+		return
+	}
+	persist := make(chan struct{}, 1)
+	reg.persist = persist
+	reg.lock.Unlock()
+
+	go func() {
+		for range persist {
+			snapshot := reg.Snapshot()
+			if !snapshot.Stale && !snapshot.Synced.IsZero() {
+				if err := writeSnapshot(path, snapshot); err != nil {
+					log.Errorf("xproxy: registry snapshot write failed %s", err.Error())
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// StopPersistence stops writing the snapshots to disk
+func (reg *Registry) StopPersistence() {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.persist != nil {
+		close(reg.persist)
+		reg.persist = nil
+	}
+}
+
+// writeSnapshot replaces the file atomically so a crash never leaves a partial snapshot behind
+func writeSnapshot(path string, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
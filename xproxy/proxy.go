@@ -1,39 +1,117 @@
 package xproxy
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
 	watch "github.com/hashicorp/consul/watch"
+	"github.com/stefanprodan/xmicro/xconsul"
+	"github.com/stefanprodan/xmicro/xserver"
+	"github.com/stefanprodan/xmicro/xtoken"
 )
 
+// RegistryVersionHeader is the response header holding the version of the registry snapshot that served the request
+const RegistryVersionHeader = "X-Registry-Version"
+
 // ReverseProxy holds the proxy configuration, registry and Consul watchers
 type ReverseProxy struct {
 	ServiceRegistry     Registry
+	Routes              *RouteTable
+	Auth                *Authenticator
+	Intentions          *Intentions
+	IPFilter            *IPFilter
+	Identity            *IdentitySigner
+	Keyring             *xtoken.Keyring
 	ElectionKeyPrefix   string
+	RoutesKeyPrefix     string
 	Scheme              string
 	MaxIdleConnsPerHost int
 	DisableKeepAlives   bool
-	serviceWatch        *watch.WatchPlan
-	leaderWatch         *watch.WatchPlan
+	// Discovery backends feeding the registry, Consul if none is set
+	Discovery []Discovery
+	// SnapshotPath is the file the registry is persisted to and loaded from at boot, empty disables persistence
+	SnapshotPath string
+	// Locality prefers the endpoints close to the proxy, endpoints are picked at random if nil
+	Locality    *Locality
+	routesWatch *watch.WatchPlan
+	forwardAuth *forwardAuthorizer
+	draining    int32
 }
 
 // StartConsulSync watches for changes in Consul Registry and syncs with the in memory registry
 func (r *ReverseProxy) StartConsulSync() error {
-	r.ServiceRegistry.Catalog = make(map[string][]string)
-	r.ServiceRegistry.GetServices(r.ElectionKeyPrefix)
+	if len(r.Discovery) == 0 {
+		r.Discovery = []Discovery{&ConsulDiscovery{ElectionKeyPrefix: r.ElectionKeyPrefix, Debounce: 500 * time.Millisecond}}
+	}
+	if r.SnapshotPath != "" {
+		backends := make([]string, 0, len(r.Discovery))
+		for _, d := range r.Discovery {
+			backends = append(backends, d.Name())
+		}
+		r.ServiceRegistry.SetBackends(backends)
+		if err := r.ServiceRegistry.LoadSnapshot(r.SnapshotPath); err != nil && !os.IsNotExist(err) {
+			log.Warnf("xproxy: registry snapshot load failed %s", err.Error())
+		}
+		r.ServiceRegistry.StartPersistence(r.SnapshotPath, 5*time.Second)
+	}
+	for _, d := range r.Discovery {
+		if err := d.Start(&r.ServiceRegistry); err != nil {
+			return err
+		}
+	}
+	if r.Routes == nil {
+		r.Routes = NewRouteTable()
+	}
+	if r.RoutesKeyPrefix == "" {
+		// no routes to wait for
+		r.Routes.Load(nil)
+	}
+	if r.Locality != nil {
+		if err := r.Locality.Resolve(); err != nil {
+			log.Warnf("xproxy: locality resolve failed %s", err.Error())
+		}
+	}
+	r.forwardAuth = newForwardAuthorizer(&r.ServiceRegistry, r.Scheme)
 	err := r.startConsulWatchers()
 	if err != nil {
 		return err
 	}
+	if r.Auth != nil {
+		err = r.Auth.StartAPIKeysSync()
+		if err != nil {
+			return err
+		}
+	}
+	if r.Keyring != nil {
+		err = r.Keyring.StartSync()
+		if err != nil {
+			return err
+		}
+	}
+	if r.IPFilter != nil {
+		err = r.IPFilter.StartSync()
+		if err != nil {
+			return err
+		}
+	}
+	if r.Intentions != nil {
+		r.Intentions.Registry = &r.ServiceRegistry
+		err = r.Intentions.StartSync()
+		if err != nil {
+			return err
+		}
+	}
 
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = r.MaxIdleConnsPerHost
 	http.DefaultTransport.(*http.Transport).DisableKeepAlives = r.DisableKeepAlives
@@ -41,6 +119,33 @@ func (r *ReverseProxy) StartConsulSync() error {
 	return nil
 }
 
+// Resync reloads the registry from the discovery backends
+func (r *ReverseProxy) Resync() error {
+	log.Info("Registry resync requested")
+	for _, d := range r.Discovery {
+		if err := d.Resync(); err != nil {
+			return fmt.Errorf("%s resync failed %s", d.Name(), err.Error())
+		}
+	}
+	return nil
+}
+
+// SetDraining toggles drain mode, while draining new requests are rejected with 503 and connections are closed
+func (r *ReverseProxy) SetDraining(draining bool) {
+	if draining {
+		atomic.StoreInt32(&r.draining, 1)
+		log.Warn("Drain mode enabled")
+	} else {
+		atomic.StoreInt32(&r.draining, 0)
+		log.Info("Drain mode disabled")
+	}
+}
+
+// Draining returns true if drain mode is enabled
+func (r *ReverseProxy) Draining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
 // HandlerFunc creates a http handler that will resolve services from Consul.
 // If a service has the cl tag, the proxy will point to the leader.
 // If multiple addresses are found for a service then it will load balance between those instances.
@@ -95,74 +200,202 @@ func parseServiceName(target *url.URL) (name string, err error) {
 	return name, nil
 }
 
-// watch for services status changes (up/down or leadership changes)
+// watch for routes changes
 func (r *ReverseProxy) startConsulWatchers() error {
-	serviceWatch, err := watch.Parse(map[string]interface{}{"type": "services"})
-	if err != nil {
-		return err
-	}
-	r.serviceWatch = serviceWatch
-	serviceWatch.Handler = r.handleServiceChanges
 	config := consul.DefaultConfig()
-	go serviceWatch.Run(config.Address)
-
-	leaderWatch, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": r.ElectionKeyPrefix})
-	if err != nil {
-		return err
+	if r.RoutesKeyPrefix != "" {
+		routesWatch, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": r.RoutesKeyPrefix})
+		if err != nil {
+			return err
+		}
+		r.routesWatch = routesWatch
+		routesWatch.Handler = r.handleRoutesChanges
+		go routesWatch.Run(config.Address)
 	}
-	r.leaderWatch = leaderWatch
-	leaderWatch.Handler = r.handleLeaderChanges
-	go leaderWatch.Run(config.Address)
 	return nil
 }
 
-// reload services from Consul
-func (r *ReverseProxy) handleServiceChanges(idx uint64, data interface{}) {
-	log.Info("Service change detected")
-	r.ServiceRegistry.GetServices(r.ElectionKeyPrefix)
-}
-
-// reload leaders from Consul
-func (r *ReverseProxy) handleLeaderChanges(idx uint64, data interface{}) {
-	log.Info("Leader change detected")
-	r.ServiceRegistry.GetServices(r.ElectionKeyPrefix)
+// reload routes from Consul
+func (r *ReverseProxy) handleRoutesChanges(idx uint64, data interface{}) {
+	log.Info("Routes change detected")
+	pairs, _ := data.(consul.KVPairs)
+	r.Routes.Load(pairs)
 }
 
 // Stop stops the Consul watchers
 func (r *ReverseProxy) Stop() {
-	r.serviceWatch.Stop()
-	r.leaderWatch.Stop()
+	for _, d := range r.Discovery {
+		d.Stop()
+	}
+	r.ServiceRegistry.StopPersistence()
+	if r.routesWatch != nil {
+		r.routesWatch.Stop()
+	}
+	if r.Auth != nil {
+		r.Auth.Stop()
+	}
+	if r.Intentions != nil {
+		r.Intentions.Stop()
+	}
+	if r.Keyring != nil {
+		r.Keyring.Stop()
+	}
+	if r.IPFilter != nil {
+		r.IPFilter.Stop()
+	}
 }
 
 // ReverseHandlerFunc creates a http handler that will resolve services from Consul.
-// If a service has the cl tag, the proxy will point to the leader.
+// If a service has the cl tag, the proxy will point to the leader, or load balance across the slot holders
+// of a role elected with a semaphore.
+// While draining or until the routes have loaded, requests are rejected with 503.
+// If the client IP is blocked by the global, service or route CIDR rules, the request is rejected with 403.
+// If the matching route has a CORS policy, preflight requests are answered by the proxy.
+// If the intentions deny the calling service access to the destination service, the request is rejected with 403.
+// If the matching route requires authentication, requests without a valid JWT or API key are rejected with 401.
+// If the matching route has forward auth, the request is proxied only if the auth service allows it.
+// If an identity signer is set, a token naming the caller, the route and the client is attached to the upstream request.
+// Requests routed to an elected role carry the fencing token of the holder they are routed to.
 func (r *ReverseProxy) ReverseHandlerFunc() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.Draining() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
 		service, err := parseServiceName(req.URL)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// only instances of a role mark the requests they forward to the leader
+		req.Header.Del(xconsul.LeaderHopHeader)
+		if !r.Routes.Loaded() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable: routes not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		route := r.Routes.Match(service, req.URL.Path)
+
+		if r.IPFilter != nil {
+			if allowed, rule := r.IPFilter.Allow(req, service, req.URL.Path); !allowed {
+				log.Debugf("xproxy: IP rule %s denied %s to %s", rule, req.RemoteAddr, service)
+				xproxy_ipfilter_denials_total.WithLabelValues(rule).Inc()
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if route.CORS != nil && route.CORS.HandleCORS(w, req) {
+			return
+		}
+		caller := ""
+		if r.Intentions != nil {
+			var allowed bool
+			caller, allowed = r.Intentions.Authorize(req, service)
+			if !allowed {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		identity, ok := r.authenticate(w, req, route)
+		if !ok {
+			return
+		}
+		if !r.authorize(w, req, route) {
+			return
+		}
+		if r.Identity != nil {
+			r.Identity.Inject(req, caller, route, identity, service)
+		}
+
 		//resolve service name address
-		endpoints, _ := r.ServiceRegistry.Lookup(service)
+		snapshot := r.ServiceRegistry.Snapshot()
+		endpoints, subset := snapshot.lookup(service, route, req)
+		w.Header().Set(RegistryVersionHeader, strconv.FormatUint(snapshot.Version, 10))
 
 		if len(endpoints) == 0 {
-			log.Warnf("xproxy: service not found in registry %s", service)
+			log.Warnf("xproxy: service not found in registry %s version %v", service, snapshot.Version)
 			return
 		}
+		if subset != nil {
+			log.Debugf("xproxy: routing %s to subset %s", service, subset.Name)
+		}
 
-		endpoint := endpoints[0]
+		endpoint := r.Locality.pick(snapshot, service, subset, endpoints)
+		snapshot.fence(req, service, endpoint)
 		redirect, _ := url.ParseRequestURI(r.Scheme + "://" + endpoint)
 
 		rproxy := httputil.NewSingleHostReverseProxy(redirect)
 		rproxy.FlushInterval = 100 * time.Microsecond
 		rproxy.Transport = &proxyTransport{
-			service: service,
+			service:    service,
+			datacenter: snapshot.Datacenter(endpoint),
+		}
+		rproxy.ErrorHandler = proxyError
+		if route.CORS != nil {
+			rproxy.ModifyResponse = stripCORSHeaders
 		}
 		rproxy.ServeHTTP(w, req)
 	})
 }
 
+// proxyError answers 413 when the request body went over the server limit while forwarding it, 502 otherwise
+func proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, xserver.ErrBodyTooLarge) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Warnf("xproxy: proxy error %s", err.Error())
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// authenticate verifies the request credentials when the route requires it and forwards the verified claims
+func (r *ReverseProxy) authenticate(w http.ResponseWriter, req *http.Request, route Route) (*Identity, bool) {
+	if r.Auth == nil {
+		if route.Auth {
+			log.Errorf("xproxy: route %s%s requires authentication but no authenticator is configured", route.Service, route.PathPrefix)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
+		return nil, true
+	}
+	if !route.Auth {
+		r.Auth.ForwardIdentity(req, nil)
+		return nil, true
+	}
+	identity, err := r.Auth.Authenticate(req)
+	if err != nil {
+		log.Debugf("xproxy: authentication failed for %s %s", route.Service, err.Error())
+		xproxy_auth_failures_total.WithLabelValues(route.Service).Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer realm="xproxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	r.Auth.ForwardIdentity(req, identity)
+	return identity, true
+}
+
+// authorize sends the forward auth subrequest and copies the auth service headers onto the upstream request,
+// client supplied values of the configured response headers are removed so they cannot be spoofed
+func (r *ReverseProxy) authorize(w http.ResponseWriter, req *http.Request, route Route) bool {
+	if route.ForwardAuth == nil {
+		return true
+	}
+	decision := r.forwardAuth.authorize(req, route.Service, route.ForwardAuth)
+	if !decision.allow {
+		log.Debugf("xproxy: forward auth denied %s %s status %v", req.Method, req.RequestURI, decision.status)
+		http.Error(w, decision.body, decision.status)
+		return false
+	}
+	for _, h := range route.ForwardAuth.ResponseHeaders {
+		req.Header.Del(h)
+	}
+	for h, values := range decision.headers {
+		req.Header[h] = values
+	}
+	return true
+}
+
 // RoundTrip records prometheus metrics. On debug logs the request URL, status code and duration.
 func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now().UTC()
@@ -170,17 +403,18 @@ func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	if err == nil {
 		log.Debugf("Round trip to %v at %v, code: %v, duration: %v", t.service, req.URL, response.StatusCode, time.Now().UTC().Sub(start))
-		xproxy_roundtrips_total.WithLabelValues(t.service, strconv.Itoa(response.StatusCode)).Inc()
+		xproxy_roundtrips_total.WithLabelValues(t.service, t.datacenter, strconv.Itoa(response.StatusCode)).Inc()
 	} else {
 		// set status code 5000 for transport errors
-		xproxy_roundtrips_total.WithLabelValues(t.service, strconv.Itoa(5000)).Inc()
+		xproxy_roundtrips_total.WithLabelValues(t.service, t.datacenter, strconv.Itoa(5000)).Inc()
 		log.Warnf("Round trip error %s", err.Error())
 	}
 
-	xproxy_roundtrips_latency.WithLabelValues(t.service).Observe(time.Since(start).Seconds())
+	xproxy_roundtrips_latency.WithLabelValues(t.service, t.datacenter).Observe(time.Since(start).Seconds())
 	return response, err
 }
 
 type proxyTransport struct {
-	service string
+	service    string
+	datacenter string
 }
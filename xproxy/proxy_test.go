@@ -0,0 +1,60 @@
+package xproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stefanprodan/xmicro/xserver"
+)
+
+// oversizedBody fails like a body cut off by the server limit once the first chunk was read
+type oversizedBody struct {
+	io.Reader
+}
+
+func (b oversizedBody) Read(p []byte) (int, error) {
+	n, _ := b.Reader.Read(p)
+	return n, xserver.ErrBodyTooLarge
+}
+
+func (b oversizedBody) Close() error {
+	return nil
+}
+
+func TestProxyErrorStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name   string
+		target *url.URL
+		body   io.ReadCloser
+		status int
+	}{
+		{"body over the limit", target, oversizedBody{strings.NewReader("chunk")}, http.StatusRequestEntityTooLarge},
+		{"upstream down", &url.URL{Scheme: "http", Host: "127.0.0.1:1"}, ioutil.NopCloser(strings.NewReader("ok")), http.StatusBadGateway},
+		{"forwarded", target, ioutil.NopCloser(strings.NewReader("ok")), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rproxy := httputil.NewSingleHostReverseProxy(tt.target)
+			rproxy.ErrorHandler = proxyError
+			req := httptest.NewRequest("POST", "http://xmicro-proxy/api/", tt.body)
+			req.ContentLength = -1
+			w := httptest.NewRecorder()
+			rproxy.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("expected %v, got %v", tt.status, w.Code)
+			}
+		})
+	}
+}
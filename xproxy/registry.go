@@ -2,90 +2,593 @@ package xproxy
 
 import (
 	"errors"
-	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	consul "github.com/hashicorp/consul/api"
+	log "github.com/Sirupsen/logrus"
+	"github.com/stefanprodan/xmicro/xconsul"
 )
 
-// Registry in memory map of elected leaders and services
+// Snapshot is an immutable view of the registry, it is replaced as a whole on every update.
+// Catalog holds the routable endpoints, Health the state of every endpoint.
+type Snapshot struct {
+	Version uint64    `json:"version"`
+	Updated time.Time `json:"updated"`
+	// Synced is the time of the last update received from a discovery backend
+	Synced time.Time `json:"synced"`
+	// Stale is true while serving a snapshot loaded from disk, until the first full sync
+	Stale   bool                `json:"stale"`
+	Catalog map[string][]string `json:"catalog"`
+	Leaders map[string]string   `json:"leaders"`
+	// Holders lists the services holding a slot of the roles elected with a semaphore
+	Holders map[string][]string `json:"holders,omitempty"`
+	// Tokens are the fencing tokens of the holders of the elected roles, forwarded to their endpoints
+	Tokens    map[string]map[string]uint64 `json:"tokens,omitempty"`
+	Health    map[string]map[string]string `json:"health"`
+	Instances map[string]xconsul.Instances `json:"instances"`
+	addresses map[string]string
+	// endpoints maps the endpoints to their instance
+	endpoints map[string]xconsul.Instance
+	disabled  map[string]map[string]bool
+}
+
+// Registry in memory map of elected leaders and services.
+// Readers get the current snapshot without locking, writers build a new snapshot and swap it atomically.
 type Registry struct {
-	Catalog map[string][]string
-	lock    sync.RWMutex
+	// HealthPolicy is passing, warning or any
+	HealthPolicy string
+	// GracePeriod keeps new endpoints routable until their first check completes
+	GracePeriod time.Duration
+	// PanicThreshold is the minimum routable fraction of a service, below it all endpoints are routed to
+	PanicThreshold float64
+	snapshot       atomic.Value
+	// writer state, guarded by lock
+	sources         map[string]map[string]xconsul.Instances
+	sourceElections map[string]map[string]string
+	entries         map[string]xconsul.Instances
+	elections       map[string]string
+	firstSeen       map[string]map[string]time.Time
+	graceTimers     map[string]*time.Timer
+	backends        []string
+	fullSynced      map[string]bool
+	version         uint64
+	synced          time.Time
+	stale           bool
+	persist         chan struct{}
+	// datacenters in failover priority order, leaderDatacenters the datacenter each role is elected in
+	datacenters       []string
+	leaderDatacenters map[string]string
+	// holders are the services holding a slot of each role elected with a semaphore
+	holders map[string][]string
+	// tokens are the fencing tokens of each role holder
+	tokens map[string]map[string]uint64
+	lock   sync.Mutex
+	// event state, guarded by eventsLock
+	subscribers  map[chan Event]bool
+	history      []Event
+	historyStart uint64
+	notify       chan struct{}
+	eventsLock   sync.Mutex
+}
+
+// EndpointStatus holds the address, health and admin state of a service endpoint
+type EndpointStatus struct {
+	Address    string `json:"address"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Health     string `json:"health"`
+	Routable   bool   `json:"routable"`
+	Disabled   bool   `json:"disabled"`
+}
+
+// emptySnapshot is served until the first update
+var emptySnapshot = &Snapshot{
+	Catalog:   map[string][]string{},
+	Leaders:   map[string]string{},
+	Holders:   map[string][]string{},
+	Tokens:    map[string]map[string]uint64{},
+	Health:    map[string]map[string]string{},
+	Instances: map[string]xconsul.Instances{},
+	addresses: map[string]string{},
+	endpoints: map[string]xconsul.Instance{},
+	disabled:  map[string]map[string]bool{},
+}
+
+// Snapshot returns the current registry snapshot
+func (reg *Registry) Snapshot() *Snapshot {
+	if snapshot, ok := reg.snapshot.Load().(*Snapshot); ok {
+		return snapshot
+	}
+	return emptySnapshot
 }
 
-// Lookup returns service endpoints
-func (reg Registry) Lookup(service string) ([]string, error) {
-	reg.lock.RLock()
-	targets, ok := reg.Catalog[service]
-	reg.lock.RUnlock()
+// Lookup returns service endpoints from the current snapshot, endpoints disabled by hand are skipped
+func (reg *Registry) Lookup(service string) ([]string, error) {
+	return reg.Snapshot().Lookup(service)
+}
+
+// Status returns all service endpoints from the current snapshot including the unhealthy and disabled ones
+func (reg *Registry) Status(service string) ([]EndpointStatus, error) {
+	return reg.Snapshot().Status(service)
+}
+
+// ServiceByAddress returns the service registered with the IP address,
+// empty if none or more than one service shares the address
+func (reg *Registry) ServiceByAddress(ip string) string {
+	return reg.Snapshot().addresses[ip]
+}
+
+// Lookup returns service endpoints, endpoints disabled by hand are skipped
+func (s *Snapshot) Lookup(service string) ([]string, error) {
+	targets, ok := s.Catalog[service]
 	if !ok {
 		return nil, errors.New("service " + service + " not found")
 	}
-	return targets, nil
+	disabled := s.disabled[service]
+	if len(disabled) == 0 {
+		return targets, nil
+	}
+	enabled := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if !disabled[t] {
+			enabled = append(enabled, t)
+		}
+	}
+	return enabled, nil
 }
 
-// GetServices gets elected leaders snd services from Consul
-func (reg Registry) GetServices(electionKeyPrefix string) error {
-
-	registry := make(map[string][]string)
+// Status returns all service endpoints including the unhealthy and disabled ones
+func (s *Snapshot) Status(service string) ([]EndpointStatus, error) {
+	health, ok := s.Health[service]
+	if !ok {
+		return nil, errors.New("service " + service + " not found")
+	}
+	routable := make(map[string]bool)
+	for _, t := range s.Catalog[service] {
+		routable[t] = true
+	}
+	status := make([]EndpointStatus, 0, len(health))
+	for endpoint, state := range health {
+		status = append(status, EndpointStatus{
+			Address:    endpoint,
+			Datacenter: s.endpoints[endpoint].Datacenter,
+			Health:     state,
+			Routable:   routable[endpoint],
+			Disabled:   s.disabled[service][endpoint],
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Address < status[j].Address })
+	return status, nil
+}
 
-	config := consul.DefaultConfig()
-	c, err := consul.NewClient(config)
-	if err != nil {
-		return err
+// SetEndpointDisabled takes an endpoint out of or back into load balancing.
+// The state is kept across registry reloads until the endpoint is enabled again.
+func (reg *Registry) SetEndpointDisabled(service string, endpoint string, disabled bool) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	next := reg.next()
+	next.disabled = make(map[string]map[string]bool, len(next.disabled))
+	for k, v := range reg.Snapshot().disabled {
+		next.disabled[k] = v
+	}
+	endpoints := make(map[string]bool)
+	for k, v := range next.disabled[service] {
+		endpoints[k] = v
+	}
+	if disabled {
+		endpoints[endpoint] = true
+	} else {
+		delete(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		delete(next.disabled, service)
+	} else {
+		next.disabled[service] = endpoints
 	}
+	reg.publish(next)
+}
 
-	services, _, err := c.Catalog().Services(nil)
-	if err != nil {
-		return err
+// next returns a shallow copy of the current snapshot to be modified by a writer, must be called with the lock held
+func (reg *Registry) next() *Snapshot {
+	current := reg.Snapshot()
+	next := &Snapshot{
+		Catalog:   make(map[string][]string, len(current.Catalog)),
+		Leaders:   make(map[string]string, len(current.Leaders)),
+		Holders:   make(map[string][]string, len(current.Holders)),
+		Tokens:    make(map[string]map[string]uint64, len(current.Tokens)),
+		Health:    make(map[string]map[string]string, len(current.Health)),
+		Instances: make(map[string]xconsul.Instances, len(current.Instances)),
+		addresses: current.addresses,
+		endpoints: current.endpoints,
+		disabled:  current.disabled,
+	}
+	for k, v := range current.Catalog {
+		next.Catalog[k] = v
+	}
+	for k, v := range current.Leaders {
+		next.Leaders[k] = v
+	}
+	for k, v := range current.Holders {
+		next.Holders[k] = v
 	}
-	for service := range services {
-		// TODO: get only healthy services (the 15s health check startup delay could be a problem)
-		services, _, err := c.Health().Service(service, "", false, nil)
-		if err != nil {
-			return err
+	for k, v := range current.Tokens {
+		next.Tokens[k] = v
+	}
+	for k, v := range current.Health {
+		next.Health[k] = v
+	}
+	for k, v := range current.Instances {
+		next.Instances[k] = v
+	}
+	return next
+}
+
+// publish versions and swaps in the new snapshot, must be called with the lock held
+func (reg *Registry) publish(next *Snapshot) {
+	reg.version++
+	next.Version = reg.version
+	next.Updated = time.Now().UTC()
+	next.Synced = reg.synced
+	next.Stale = reg.stale
+	prev := reg.Snapshot()
+	reg.snapshot.Store(next)
+	if reg.persist != nil {
+		select {
+		case reg.persist <- struct{}{}:
+		default:
 		}
+	}
+	reg.emit(diffSnapshots(prev, next))
+}
 
-		for _, s := range services {
-			if s.Service.Address == "" {
-				continue
+// ElectionState is the resolved state of the elections of a backend: the leader, the services holding
+// a slot, the fencing tokens of the holders and the datacenter each role is elected in
+type ElectionState struct {
+	Leaders     map[string]string
+	Holders     map[string][]string
+	Tokens      map[string]map[string]uint64
+	Datacenters map[string]string
+}
+
+// Replace replaces all instances and elections reported by a discovery backend.
+// While the snapshot loaded from disk is served, the backend services replace their snapshot copy
+// and the rest of the snapshot is dropped once every backend has done a full sync.
+func (reg *Registry) Replace(source string, instances map[string]xconsul.Instances, elections map[string]string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.init()
+	reg.replace(source, instances, elections)
+}
+
+// ReplaceElections replaces all instances of a discovery backend and its election state in one snapshot
+func (reg *Registry) ReplaceElections(source string, instances map[string]xconsul.Instances, state *ElectionState) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.init()
+	reg.replace(source, instances, reg.setElectionState(state))
+}
+
+// replace replaces the instances and elections of the backend, must be called with the lock held
+func (reg *Registry) replace(source string, instances map[string]xconsul.Instances, elections map[string]string) {
+	removed := make([]string, 0)
+	for service := range reg.sources[source] {
+		if _, ok := instances[service]; !ok {
+			removed = append(removed, service)
+		}
+	}
+	if reg.stale && source != snapshotSource {
+		// the services reported by the backend replace their copy from the snapshot loaded from disk
+		for service := range instances {
+			delete(reg.sources[snapshotSource], service)
+		}
+		reg.fullSynced[source] = true
+		if reg.backendsSynced() {
+			// the snapshot services not reported by any backend are removed
+			for service := range reg.sources[snapshotSource] {
+				removed = append(removed, service)
 			}
-			// detect if service is subject to leader election
-			if len(s.Service.Tags) >= 2 && s.Service.Tags[0] == "le" {
-				// compose election key using the second tag
-				var electionKey = electionKeyPrefix + s.Service.Tags[1]
-				kvpair, _, err := c.KV().Get(electionKey, nil)
-				if kvpair != nil && err == nil {
-					// check if a session is locking the key
-					sessionInfo, _, err := c.Session().Info(kvpair.Session, nil)
-					if err == nil && sessionInfo != nil {
-						// extract leader name from session name and validate
-						_, present := registry[s.Service.Tags[1]]
-						if !present && service == sessionInfo.Name {
-							// add service to registry using the tag only if the current service is the leader
-							registry[s.Service.Tags[1]] = append(registry[s.Service.Tags[1]], fmt.Sprintf("%s:%v", s.Service.Address, s.Service.Port))
-						}
-					} else {
-						return err
-					}
-				}
-			} else {
-				// add service for load balancing
-				registry[service] = append(registry[service], fmt.Sprintf("%s:%v", s.Service.Address, s.Service.Port))
+			delete(reg.sources, snapshotSource)
+			delete(reg.sourceElections, snapshotSource)
+			if elections == nil {
+				elections = reg.sourceElections[source]
 			}
+			if elections == nil {
+				elections = map[string]string{}
+			}
+			reg.stale = false
+			log.Infof("Registry synced by %s, the snapshot loaded from disk is no longer served", source)
 		}
 	}
+	reg.update(source, instances, removed, elections)
+}
+
+// Update updates the changed services of a discovery backend, removes the deregistered ones
+// and, if not nil, replaces the elections of the backend.
+// Only the changed services and the roles they are elected for are rebuilt.
+func (reg *Registry) Update(source string, changed map[string]xconsul.Instances, removed []string, elections map[string]string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.init()
+	reg.update(source, changed, removed, elections)
+}
 
-	// update local registry
+// UpdateElections updates the changed services of a discovery backend and, if not nil, replaces
+// its election state, the holders and fencing tokens are published in the same snapshot as the leaders
+func (reg *Registry) UpdateElections(source string, changed map[string]xconsul.Instances, removed []string, state *ElectionState) {
 	reg.lock.Lock()
 	defer reg.lock.Unlock()
-	for k := range reg.Catalog {
-		delete(reg.Catalog, k)
+	reg.init()
+	reg.update(source, changed, removed, reg.setElectionState(state))
+}
+
+// setElectionState sets the slot holders, fencing tokens and leader datacenters of the state and returns
+// its leaders, nil if state is nil, must be called with the lock held
+func (reg *Registry) setElectionState(state *ElectionState) map[string]string {
+	if state == nil {
+		return nil
+	}
+	reg.holders = state.Holders
+	reg.tokens = state.Tokens
+	reg.leaderDatacenters = state.Datacenters
+	if state.Leaders == nil {
+		return map[string]string{}
+	}
+	return state.Leaders
+}
+
+// update merges the backend changes with the instances of the other backends, must be called with the lock held
+func (reg *Registry) update(source string, changed map[string]xconsul.Instances, removed []string, elections map[string]string) {
+	if source != snapshotSource {
+		reg.synced = time.Now().UTC()
 	}
-	for k, v := range registry {
-		reg.Catalog[k] = v
+	if reg.sources[source] == nil {
+		reg.sources[source] = make(map[string]xconsul.Instances)
 	}
+	services := make([]string, 0, len(changed)+len(removed))
+	for service, instances := range changed {
+		reg.sources[source][service] = instances
+		services = append(services, service)
+	}
+	for _, service := range removed {
+		delete(reg.sources[source], service)
+		services = append(services, service)
+	}
+
+	merged := make(map[string]xconsul.Instances, len(services))
+	gone := make([]string, 0)
+	for _, service := range services {
+		instances := make(xconsul.Instances, 0)
+		found := false
+		for _, name := range reg.sourceNames() {
+			if i, ok := reg.sources[name][service]; ok {
+				instances = append(instances, i...)
+				found = true
+			}
+		}
+		if found {
+			merged[service] = instances
+		} else {
+			gone = append(gone, service)
+		}
+	}
+
+	var mergedElections map[string]string
+	if elections != nil {
+		reg.sourceElections[source] = elections
+		// the first backend in name order wins a role elected in more than one backend
+		mergedElections = make(map[string]string)
+		names := reg.sourceNames()
+		for n := len(names) - 1; n >= 0; n-- {
+			for role, leader := range reg.sourceElections[names[n]] {
+				mergedElections[role] = leader
+			}
+		}
+	}
+	reg.apply(merged, gone, mergedElections)
+}
+
+// sourceNames returns the discovery backend names sorted
+func (reg *Registry) sourceNames() []string {
+	names := make([]string, 0, len(reg.sources))
+	for name := range reg.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// init allocates the writer state on first use, must be called with the lock held
+func (reg *Registry) init() {
+	if reg.entries == nil {
+		reg.sources = make(map[string]map[string]xconsul.Instances)
+		reg.sourceElections = make(map[string]map[string]string)
+		reg.entries = make(map[string]xconsul.Instances)
+		reg.elections = make(map[string]string)
+		reg.firstSeen = make(map[string]map[string]time.Time)
+		reg.graceTimers = make(map[string]*time.Timer)
+		reg.fullSynced = make(map[string]bool)
+	}
+}
 
-	return nil
+// apply builds and publishes the next snapshot, must be called with the lock held
+func (reg *Registry) apply(changed map[string]xconsul.Instances, removed []string, elections map[string]string) {
+	now := time.Now()
+	next := reg.next()
+	roles := make(map[string]bool)
+	for _, service := range removed {
+		delete(reg.entries, service)
+		delete(reg.firstSeen, service)
+		reg.rebuildService(next, service, roles, now)
+	}
+	for service, entries := range changed {
+		reg.entries[service] = entries
+		reg.rebuildService(next, service, roles, now)
+	}
+	if elections != nil {
+		for role := range reg.elections {
+			roles[role] = true
+		}
+		for role := range elections {
+			roles[role] = true
+		}
+		for role := range reg.elections {
+			delete(reg.elections, role)
+		}
+		for role, leader := range elections {
+			reg.elections[role] = leader
+		}
+	}
+	for role := range roles {
+		reg.rebuildRole(next, role)
+	}
+	holders := reg.electedHolders()
+	for service := range changed {
+		next.Instances[service] = reg.entries[service].MarkHolders(holders)
+	}
+	for _, service := range removed {
+		delete(next.Instances, service)
+	}
+	if elections != nil {
+		for service, instances := range reg.entries {
+			next.Instances[service] = instances.MarkHolders(holders)
+		}
+	}
+	reg.rebuildAddresses(next)
+	reg.publish(next)
+}
+
+// rebuildService recomputes the health and routable endpoints of a service
+// and collects the roles it takes part in the election for
+func (reg *Registry) rebuildService(next *Snapshot, service string, roles map[string]bool, now time.Time) {
+	for role, leader := range next.Leaders {
+		if leader == service {
+			roles[role] = true
+		}
+	}
+	delete(next.Catalog, service)
+	delete(next.Health, service)
+
+	entries := reg.entries[service]
+	health := make(map[string]string)
+	firstSeen := make(map[string]time.Time)
+	datacenters := make(map[string]string)
+	candidates := make([]string, 0, len(entries))
+	var graceEnd time.Time
+	for _, instance := range entries {
+		if instance.Address == "" {
+			continue
+		}
+		endpoint := instance.Endpoint()
+		// track when the endpoint was first seen for the startup grace period
+		seen, ok := reg.firstSeen[service][endpoint]
+		if !ok {
+			seen = now
+		}
+		firstSeen[endpoint] = seen
+		health[endpoint] = reg.healthState(instance, seen, now)
+		if end := seen.Add(reg.GracePeriod); health[endpoint] == healthStarting && (graceEnd.IsZero() || end.Before(graceEnd)) {
+			graceEnd = end
+		}
+		datacenters[endpoint] = instance.Datacenter
+		// detect if service is subject to leader election
+		if role, ok := instance.ElectionRole(); ok {
+			roles[role] = true
+			continue
+		}
+		candidates = append(candidates, endpoint)
+	}
+	if len(entries) > 0 {
+		reg.firstSeen[service] = firstSeen
+	}
+	reg.scheduleGrace(service, graceEnd, now)
+	if len(candidates) == 0 {
+		return
+	}
+
+	// add healthy endpoints of the preferred datacenter for load balancing
+	preferred := reg.preferredEndpoints(service, candidates, health, datacenters)
+	routable := make([]string, 0, len(preferred))
+	for _, endpoint := range preferred {
+		if reg.routable(health[endpoint]) {
+			routable = append(routable, endpoint)
+		}
+	}
+	// panic mode: route to all endpoints when too few are healthy
+	if float64(len(routable))/float64(len(preferred)) < reg.PanicThreshold {
+		log.Warnf("xproxy: %s has %v of %v endpoints healthy, panic mode routes to all", service, len(routable), len(preferred))
+		routable = preferred
+	}
+	serviceHealth := make(map[string]string, len(candidates))
+	for _, endpoint := range candidates {
+		serviceHealth[endpoint] = health[endpoint]
+	}
+	next.Health[service] = serviceHealth
+	if len(routable) > 0 {
+		next.Catalog[service] = routable
+	}
+}
+
+// rebuildRole points the role to the first endpoint of the elected service tagged with the role
+func (reg *Registry) rebuildRole(next *Snapshot, role string) {
+	delete(next.Catalog, role)
+	delete(next.Health, role)
+	delete(next.Leaders, role)
+	delete(next.Holders, role)
+	delete(next.Tokens, role)
+
+	leader, ok := reg.elections[role]
+	if !ok {
+		return
+	}
+	// add service to registry using the tag only if the current service is the leader or holds a slot
+	endpoints := make([]string, 0)
+	health := make(map[string]string)
+	for _, service := range reg.roleHolders(role) {
+		instance, ok := reg.roleInstance(service, role)
+		if !ok {
+			continue
+		}
+		endpoint := instance.Endpoint()
+		endpoints = append(endpoints, endpoint)
+		health[endpoint] = reg.healthState(instance, reg.firstSeen[service][endpoint], time.Now())
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+	next.Catalog[role] = endpoints
+	next.Leaders[role] = leader
+	next.Health[role] = health
+	if holders := reg.holders[role]; len(holders) > 1 {
+		next.Holders[role] = holders
+	}
+	if tokens, ok := reg.tokens[role]; ok {
+		next.Tokens[role] = tokens
+	}
+}
+
+// rebuildAddresses indexes addresses for source identification, shared addresses are ambiguous,
+// and the instance of each endpoint
+func (reg *Registry) rebuildAddresses(next *Snapshot) {
+	addresses := make(map[string]string)
+	next.endpoints = make(map[string]xconsul.Instance)
+	for service, entries := range reg.entries {
+		for _, instance := range entries {
+			if instance.Address == "" {
+				continue
+			}
+			next.endpoints[instance.Endpoint()] = instance
+			if owner, ok := addresses[instance.Address]; ok && owner != service {
+				addresses[instance.Address] = ""
+			} else if !ok {
+				addresses[instance.Address] = service
+			}
+		}
+	}
+	next.addresses = make(map[string]string, len(addresses))
+	for k, v := range addresses {
+		if v != "" {
+			next.addresses[k] = v
+		}
+	}
 }
@@ -0,0 +1,183 @@
+package xproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+func testInstances(service string, n int) xconsul.Instances {
+	instances := make(xconsul.Instances, 0, n)
+	for i := 0; i < n; i++ {
+		instances = append(instances, xconsul.Instance{
+			ID:      fmt.Sprintf("%s-%v", service, i),
+			Service: service,
+			Address: fmt.Sprintf("10.0.0.%v", i+1),
+			Port:    8080,
+			Health:  consul.HealthPassing,
+		})
+	}
+	return instances
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 3)}, nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				reg.Replace("consul", map[string]xconsul.Instances{
+					"api":    testInstances("api", 1+(i+w)%3),
+					"worker": testInstances("worker", 2),
+				}, map[string]string{"leader": "worker"})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				endpoints, err := reg.Lookup("api")
+				if err != nil {
+					t.Errorf("lookup api failed %s", err.Error())
+					return
+				}
+				for _, endpoint := range endpoints {
+					if endpoint == "" {
+						t.Errorf("lookup api returned an empty endpoint")
+						return
+					}
+				}
+				reg.Status("api")
+				reg.ServiceByAddress("10.0.0.1")
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				reg.SetEndpointDisabled("api", "10.0.0.1:8080", (i+w)%2 == 0)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	reg.SetEndpointDisabled("api", "10.0.0.1:8080", false)
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 3)}, nil)
+	endpoints, err := reg.Lookup("api")
+	if err != nil {
+		t.Fatalf("lookup api failed %s", err.Error())
+	}
+	if len(endpoints) != 3 {
+		t.Fatalf("expected 3 api endpoints, got %v", endpoints)
+	}
+}
+
+func TestRegistrySetEndpointDisabled(t *testing.T) {
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 2)}, nil)
+
+	reg.SetEndpointDisabled("api", "10.0.0.1:8080", true)
+	endpoints, _ := reg.Lookup("api")
+	if len(endpoints) != 1 || endpoints[0] != "10.0.0.2:8080" {
+		t.Fatalf("expected the disabled endpoint to be skipped, got %v", endpoints)
+	}
+
+	// the disabled state is kept across reloads
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 2)}, nil)
+	endpoints, _ = reg.Lookup("api")
+	if len(endpoints) != 1 {
+		t.Fatalf("expected the endpoint to stay disabled after a reload, got %v", endpoints)
+	}
+
+	reg.SetEndpointDisabled("api", "10.0.0.1:8080", false)
+	endpoints, _ = reg.Lookup("api")
+	if len(endpoints) != 2 {
+		t.Fatalf("expected both endpoints after enabling, got %v", endpoints)
+	}
+}
+
+func TestRegistrySnapshotServedUntilBackendsSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.json")
+	snapshot := &Snapshot{
+		Synced: time.Now().UTC(),
+		Instances: map[string]xconsul.Instances{
+			"api":    testInstances("api", 2),
+			"worker": testInstances("worker", 1),
+		},
+	}
+	if err := writeSnapshot(path, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.SetBackends([]string{"consul", "file"})
+	if err := reg.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// consul reports api only, worker is kept from the snapshot until the file backend syncs
+	reg.Replace("consul", map[string]xconsul.Instances{"api": testInstances("api", 1)}, nil)
+	if endpoints, _ := reg.Lookup("api"); len(endpoints) != 1 {
+		t.Fatalf("expected the api endpoint reported by consul, got %v", endpoints)
+	}
+	if endpoints, _ := reg.Lookup("worker"); len(endpoints) != 1 {
+		t.Fatalf("expected the worker endpoint from the snapshot, got %v", endpoints)
+	}
+	if !reg.Snapshot().Stale {
+		t.Fatal("expected the snapshot to be stale until every backend synced")
+	}
+
+	reg.Replace("file", map[string]xconsul.Instances{}, nil)
+	if endpoints, err := reg.Lookup("worker"); err == nil && len(endpoints) > 0 {
+		t.Fatalf("expected worker to be removed once every backend synced, got %v", endpoints)
+	}
+	if reg.Snapshot().Stale {
+		t.Fatal("expected the snapshot not to be stale once every backend synced")
+	}
+}
+
+func TestRegistryUpdateElectionsPublishesOneVersion(t *testing.T) {
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	instances := map[string]xconsul.Instances{}
+	for _, service := range []string{"node1", "node2"} {
+		i := testInstances(service, 1)
+		i[0].Tags = []string{"le", "shard1"}
+		instances[service] = i
+	}
+	reg.Replace("consul", instances, nil)
+	version := reg.Snapshot().Version
+
+	reg.UpdateElections("consul", nil, nil, &ElectionState{
+		Leaders: map[string]string{"shard1": "node1"},
+		Holders: map[string][]string{"shard1": {"node1", "node2"}},
+		Tokens:  map[string]map[string]uint64{"shard1": {"node1": 7, "node2": 8}},
+	})
+	snapshot := reg.Snapshot()
+	if snapshot.Version != version+1 {
+		t.Fatalf("expected one new version, got %v after %v", snapshot.Version, version)
+	}
+	if snapshot.Leaders["shard1"] != "node1" || len(snapshot.Holders["shard1"]) != 2 || snapshot.Tokens["shard1"]["node2"] != 8 {
+		t.Fatalf("expected the leader, holders and tokens in the same snapshot, got %v %v %v",
+			snapshot.Leaders, snapshot.Holders, snapshot.Tokens)
+	}
+
+	// a nil state keeps the elections
+	reg.UpdateElections("consul", map[string]xconsul.Instances{"node1": instances["node1"]}, nil, nil)
+	if snapshot := reg.Snapshot(); snapshot.Tokens["shard1"]["node1"] != 7 {
+		t.Fatalf("expected the tokens to be kept, got %v", snapshot.Tokens)
+	}
+}
@@ -0,0 +1,152 @@
+package xproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Route holds the proxy settings for a service path, stored in Consul KV as JSON under the routes key prefix
+type Route struct {
+	Service     string       `json:"service"`
+	PathPrefix  string       `json:"path_prefix,omitempty"`
+	Auth        bool         `json:"auth,omitempty"`
+	ForwardAuth *ForwardAuth `json:"forward_auth,omitempty"`
+	CORS        *CORSPolicy  `json:"cors,omitempty"`
+	// Subsets route the matching requests to a subset of the service instances
+	Subsets []Subset `json:"subsets,omitempty"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string like 30s or 5m
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON encodes the duration as string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// RouteTable in memory map of services and their routes
+type RouteTable struct {
+	routes map[string][]Route
+	// byKey holds the last valid route of each KV key
+	byKey  map[string]Route
+	loaded bool
+	lock   sync.RWMutex
+}
+
+// NewRouteTable returns an empty RouteTable, the table is not loaded until the first Load
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		routes: make(map[string][]Route),
+		byKey:  make(map[string]Route),
+	}
+}
+
+// Loaded returns true once the routes have been loaded
+func (t *RouteTable) Loaded() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.loaded
+}
+
+// Match returns the route with the longest path prefix matching the service path.
+// If no route is defined for the service a default route without restrictions is returned.
+func (t *RouteTable) Match(service string, path string) Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	match := Route{Service: service}
+	found := false
+	for _, route := range t.routes[service] {
+		if strings.HasPrefix(path, route.PathPrefix) && (!found || len(route.PathPrefix) > len(match.PathPrefix)) {
+			match = route
+			found = true
+		}
+	}
+	return match
+}
+
+// All returns a copy of the routes
+func (t *RouteTable) All() []Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	routes := make([]Route, 0)
+	for _, r := range t.routes {
+		routes = append(routes, r...)
+	}
+	return routes
+}
+
+// Load replaces the routes with the ones decoded from the KV pairs.
+// An invalid value keeps the previous route of its key, invalid new keys are skipped.
+func (t *RouteTable) Load(pairs consul.KVPairs) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	byKey := make(map[string]Route, len(pairs))
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		route, err := decodeRoute(pair.Value)
+		if err != nil {
+			previous, ok := t.byKey[pair.Key]
+			if !ok {
+				log.Warnf("xproxy: invalid route %s %s", pair.Key, err.Error())
+				continue
+			}
+			log.Warnf("xproxy: invalid route %s %s, keeping the previous route", pair.Key, err.Error())
+			route = previous
+		}
+		byKey[pair.Key] = route
+	}
+	routes := make(map[string][]Route)
+	for _, route := range byKey {
+		routes[route.Service] = append(routes[route.Service], route)
+	}
+	t.byKey = byKey
+	t.routes = routes
+	t.loaded = true
+}
+
+// decodeRoute decodes and validates a route
+func decodeRoute(value []byte) (Route, error) {
+	var route Route
+	if err := json.Unmarshal(value, &route); err != nil {
+		return route, err
+	}
+	if route.Service == "" {
+		return route, errors.New("service is missing")
+	}
+	if route.ForwardAuth != nil && route.ForwardAuth.Service == "" {
+		return route, errors.New("forward auth service is missing")
+	}
+	if !validSubsets(route.Subsets) {
+		return route, errors.New("subsets require a name and tags or meta")
+	}
+	if route.CORS != nil {
+		if err := route.CORS.validate(); err != nil {
+			return route, err
+		}
+	}
+	return route, nil
+}
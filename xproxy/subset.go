@@ -0,0 +1,112 @@
+package xproxy
+
+import (
+	"net/http"
+
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// ServiceVersionHeader selects the instances tagged with the version or with the version service meta
+const ServiceVersionHeader = "X-Service-Version"
+
+// Subset selects the instances of a service by tags and service meta, node meta is used as fallback.
+// A subset with headers applies only to the requests carrying all of them,
+// one without is the default subset of the route.
+type Subset struct {
+	Name    string            `json:"name"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// Matches returns true if the request carries the subset headers
+func (s Subset) Matches(req *http.Request) bool {
+	for name, value := range s.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the instances matching the subset tags and meta
+func (s Subset) Select(instances xconsul.Instances) xconsul.Instances {
+	for _, tag := range s.Tags {
+		instances = instances.WithTag(tag)
+	}
+	for key, value := range s.Meta {
+		instances = instances.WithMeta(key, value)
+	}
+	return instances
+}
+
+// subsets returns the subsets to try in order: the first route subset whose headers match the request,
+// the version subsets if the client sent the version header, then the route default subsets without headers.
+// The instances with the version meta are preferred over the ones tagged with the version.
+func (route Route) subsets(req *http.Request) []Subset {
+	subsets := make([]Subset, 0)
+	for _, s := range route.Subsets {
+		if len(s.Headers) > 0 && s.Matches(req) {
+			subsets = append(subsets, s)
+			break
+		}
+	}
+	if version := req.Header.Get(ServiceVersionHeader); version != "" && len(subsets) == 0 {
+		subsets = append(subsets,
+			Subset{Name: version, Meta: map[string]string{"version": version}},
+			Subset{Name: version, Tags: []string{version}},
+		)
+	}
+	for _, s := range route.Subsets {
+		if len(s.Headers) == 0 {
+			subsets = append(subsets, s)
+		}
+	}
+	return subsets
+}
+
+// LookupSubset returns the service endpoints of the subset, endpoints disabled by hand are skipped
+func (s *Snapshot) LookupSubset(service string, subset Subset) ([]string, error) {
+	endpoints, err := s.Lookup(service)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, i := range subset.Select(s.Instances[service]) {
+		selected[i.Endpoint()] = true
+	}
+	matched := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if selected[endpoint] {
+			matched = append(matched, endpoint)
+		}
+	}
+	return matched, nil
+}
+
+// selects returns true if the instance is part of the subset, every instance is part of a nil subset
+func (s *Subset) selects(instance xconsul.Instance) bool {
+	return s == nil || len(s.Select(xconsul.Instances{instance})) > 0
+}
+
+// lookup returns the endpoints of the first request subset with routable endpoints and the subset,
+// or all service endpoints and nil if none has
+func (s *Snapshot) lookup(service string, route Route, req *http.Request) ([]string, *Subset) {
+	for _, subset := range route.subsets(req) {
+		if endpoints, _ := s.LookupSubset(service, subset); len(endpoints) > 0 {
+			return endpoints, &subset
+		}
+	}
+	endpoints, _ := s.Lookup(service)
+	return endpoints, nil
+}
+
+// validSubsets returns false if a subset has no name or selects all instances
+func validSubsets(subsets []Subset) bool {
+	for _, s := range subsets {
+		if s.Name == "" || len(s.Tags) == 0 && len(s.Meta) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package xproxy
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stefanprodan/xmicro/xconsul"
+)
+
+// testSubsetRegistry registers api instances tagged v1, tagged v2, with the v2 version meta and tagged canary in zone a
+func testSubsetRegistry() *Registry {
+	instances := testInstances("api", 4)
+	instances[0].Tags = []string{"v1"}
+	instances[0].Meta = map[string]string{"version": "v1"}
+	instances[1].Tags = []string{"v2"}
+	instances[2].Meta = map[string]string{"version": "v2"}
+	instances[3].Tags = []string{"canary"}
+	instances[3].NodeMeta = map[string]string{"zone": "a"}
+	reg := &Registry{HealthPolicy: HealthPolicyPassing}
+	reg.Replace("consul", map[string]xconsul.Instances{"api": instances}, nil)
+	return reg
+}
+
+var testSubsetRoute = Route{Subsets: []Subset{
+	{Name: "canary", Headers: map[string]string{"X-Canary": "1"}, Tags: []string{"canary"}},
+	{Name: "stable", Tags: []string{"v1"}},
+}}
+
+func TestRouteSubsets(t *testing.T) {
+	canary, stable := testSubsetRoute.Subsets[0], testSubsetRoute.Subsets[1]
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected []Subset
+	}{
+		{"default", nil, []Subset{stable}},
+		{"header match", map[string]string{"X-Canary": "1"}, []Subset{canary, stable}},
+		{"header mismatch", map[string]string{"X-Canary": "0"}, []Subset{stable}},
+		{"version", map[string]string{ServiceVersionHeader: "v2"}, []Subset{
+			{Name: "v2", Meta: map[string]string{"version": "v2"}},
+			{Name: "v2", Tags: []string{"v2"}},
+			stable,
+		}},
+		{"header match before version", map[string]string{"X-Canary": "1", ServiceVersionHeader: "v2"}, []Subset{canary, stable}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if subsets := testSubsetRoute.subsets(req); !reflect.DeepEqual(subsets, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, subsets)
+			}
+		})
+	}
+}
+
+func TestSnapshotLookupSubset(t *testing.T) {
+	snapshot := testSubsetRegistry().Snapshot()
+	tests := []struct {
+		name     string
+		subset   Subset
+		expected []string
+	}{
+		{"tag", Subset{Tags: []string{"v2"}}, []string{"10.0.0.2:8080"}},
+		{"meta", Subset{Meta: map[string]string{"version": "v2"}}, []string{"10.0.0.3:8080"}},
+		{"tag and meta", Subset{Tags: []string{"v1"}, Meta: map[string]string{"version": "v1"}}, []string{"10.0.0.1:8080"}},
+		{"node meta", Subset{Meta: map[string]string{"zone": "a"}}, []string{"10.0.0.4:8080"}},
+		{"no match", Subset{Tags: []string{"v3"}}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints, err := snapshot.LookupSubset("api", tt.subset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(endpoints, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, endpoints)
+			}
+		})
+	}
+	if _, err := snapshot.LookupSubset("web", Subset{Tags: []string{"v1"}}); err == nil {
+		t.Fatal("expected an error for an unknown service")
+	}
+}
+
+func TestSnapshotLookupFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    Route
+		headers  map[string]string
+		disabled string
+		expected []string
+		subset   string
+	}{
+		{"default subset", testSubsetRoute, nil, "", []string{"10.0.0.1:8080"}, "stable"},
+		{"header subset", testSubsetRoute, map[string]string{"X-Canary": "1"}, "", []string{"10.0.0.4:8080"}, "canary"},
+		{"header subset disabled", testSubsetRoute, map[string]string{"X-Canary": "1"}, "10.0.0.4:8080", []string{"10.0.0.1:8080"}, "stable"},
+		{"version meta preferred", testSubsetRoute, map[string]string{ServiceVersionHeader: "v2"}, "", []string{"10.0.0.3:8080"}, "v2"},
+		{"version tags", testSubsetRoute, map[string]string{ServiceVersionHeader: "v2"}, "10.0.0.3:8080", []string{"10.0.0.2:8080"}, "v2"},
+		{"unknown version", testSubsetRoute, map[string]string{ServiceVersionHeader: "v3"}, "", []string{"10.0.0.1:8080"}, "stable"},
+		{"default subset disabled", testSubsetRoute, nil, "10.0.0.1:8080",
+			[]string{"10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}, ""},
+		{"no subsets", Route{}, nil, "",
+			[]string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := testSubsetRegistry()
+			if tt.disabled != "" {
+				reg.SetEndpointDisabled("api", tt.disabled, true)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			endpoints, subset := reg.Snapshot().lookup("api", tt.route, req)
+			if !reflect.DeepEqual(endpoints, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, endpoints)
+			}
+			name := ""
+			if subset != nil {
+				name = subset.Name
+			}
+			if name != tt.subset {
+				t.Fatalf("expected subset %q, got %q", tt.subset, name)
+			}
+		})
+	}
+}
+
+func TestValidSubsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		subsets []Subset
+		valid   bool
+	}{
+		{"none", nil, true},
+		{"tags", []Subset{{Name: "stable", Tags: []string{"v1"}}}, true},
+		{"meta", []Subset{{Name: "stable", Meta: map[string]string{"version": "v1"}}}, true},
+		{"no name", []Subset{{Tags: []string{"v1"}}}, false},
+		{"selects all", []Subset{{Name: "canary", Headers: map[string]string{"X-Canary": "1"}}}, false},
+		{"one invalid", []Subset{{Name: "stable", Tags: []string{"v1"}}, {Name: "all"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := validSubsets(tt.subsets); valid != tt.valid {
+				t.Fatalf("expected %v, got %v", tt.valid, valid)
+			}
+		})
+	}
+}
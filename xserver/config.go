@@ -0,0 +1,82 @@
+package xserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the HTTP server timeouts and limits
+type Config struct {
+	// ReadHeaderTimeout limits the time a client has to send the request headers
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout limits the time a client has to send the whole request, including the body
+	ReadTimeout time.Duration
+	// WriteTimeout limits the time spent writing the response
+	WriteTimeout time.Duration
+	// IdleTimeout limits the time a keep-alive connection can stay idle between requests
+	IdleTimeout time.Duration
+	// MaxHeaderBytes limits the size of the request headers
+	MaxHeaderBytes int
+	// MaxBodyBytes is the default request body limit, zero disables it
+	MaxBodyBytes int64
+	// RouteBodyLimits overrides MaxBodyBytes for requests matching a path prefix
+	RouteBodyLimits map[string]int64
+	// MaxConns limits the number of concurrent connections per listener, zero disables it
+	MaxConns int
+	// MaxConnsPerIP limits the number of concurrent connections per client IP, zero disables it
+	MaxConnsPerIP int
+	// TLSCertFile and TLSKeyFile enable TLS when set
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables verification of client certificates, clients without a certificate are still accepted
+	TLSClientCAFile string
+}
+
+// DefaultConfig returns a Config with sane limits for both proxy and API roles
+func DefaultConfig() Config {
+	return Config{
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+		MaxBodyBytes:      10 << 20,
+		RouteBodyLimits:   make(map[string]int64),
+		MaxConns:          10000,
+	}
+}
+
+// BodyLimit returns the request body limit for the specified path using the longest matching route prefix
+func (c Config) BodyLimit(path string) int64 {
+	limit := c.MaxBodyBytes
+	match := ""
+	for prefix, l := range c.RouteBodyLimits {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(match) {
+			match = prefix
+			limit = l
+		}
+	}
+	return limit
+}
+
+// ParseRouteLimits parses body limits in the format /prefix=bytes,/prefix=bytes
+func ParseRouteLimits(value string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	if strings.TrimSpace(value) == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return nil, fmt.Errorf("xserver: invalid route limit %s, format /prefix=bytes", pair)
+		}
+		limit, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("xserver: invalid route limit %s, bytes must be a positive integer", pair)
+		}
+		limits[kv[0]] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,100 @@
+package xserver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rejection response written to clients over the connection limits
+var overloadResponse = []byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+
+// limitListener caps the number of concurrent connections per listener and per client IP
+type limitListener struct {
+	net.Listener
+	name          string
+	maxConns      int
+	maxConnsPerIP int
+	conns         int
+	perIP         map[string]int
+	mutex         sync.Mutex
+}
+
+func newLimitListener(l net.Listener, name string, maxConns int, maxConnsPerIP int) net.Listener {
+	return &limitListener{
+		Listener:      l,
+		name:          name,
+		maxConns:      maxConns,
+		maxConnsPerIP: maxConnsPerIP,
+		perIP:         make(map[string]int),
+	}
+}
+
+// Accept waits for the next connection within limits, connections over the limits are rejected with 503
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(c.RemoteAddr())
+		reason := l.acquire(ip)
+		if reason == "" {
+			return &limitConn{Conn: c, release: func() { l.release(ip) }}, nil
+		}
+		xserver_rejections_total.WithLabelValues(l.name, reason).Inc()
+		go reject(c)
+	}
+}
+
+func (l *limitListener) acquire(ip string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		return "max_conns"
+	}
+	if l.maxConnsPerIP > 0 && l.perIP[ip] >= l.maxConnsPerIP {
+		return "max_conns_per_ip"
+	}
+	l.conns++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *limitListener) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conns--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// reject writes a 503 without reading the request, a slow client can't hold the connection open
+func reject(c net.Conn) {
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Write(overloadResponse)
+	c.Close()
+}
+
+// limitConn releases its listener slot once closed
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,102 @@
+package xserver
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimitListenerAcquire(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxConns      int
+		maxConnsPerIP int
+		ips           []string
+		reasons       []string
+	}{
+		{"no limits", 0, 0, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, []string{"", "", ""}},
+		{"max conns", 2, 0, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{"", "", "max_conns"}},
+		{"max conns per ip", 0, 1, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}, []string{"", "", "max_conns_per_ip"}},
+		{"max conns first", 1, 1, []string{"10.0.0.1", "10.0.0.1"}, []string{"", "max_conns"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimitListener(nil, "test", tt.maxConns, tt.maxConnsPerIP).(*limitListener)
+			for n, ip := range tt.ips {
+				if reason := l.acquire(ip); reason != tt.reasons[n] {
+					t.Fatalf("connection %v from %s: expected %q, got %q", n, ip, tt.reasons[n], reason)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitListenerRelease(t *testing.T) {
+	l := newLimitListener(nil, "test", 1, 1).(*limitListener)
+	if reason := l.acquire("10.0.0.1"); reason != "" {
+		t.Fatalf("expected the first connection to be accepted, got %s", reason)
+	}
+	l.release("10.0.0.1")
+	if len(l.perIP) != 0 || l.conns != 0 {
+		t.Fatalf("expected no connection left, got %v %v", l.conns, l.perIP)
+	}
+	if reason := l.acquire("10.0.0.1"); reason != "" {
+		t.Fatalf("expected a released slot to be reused, got %s", reason)
+	}
+}
+
+func TestLimitListenerRejects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(ln, "test", 1, 0)
+	defer l.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	held := <-accepted
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil {
+		t.Fatalf("expected a 503 response, got %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", resp.StatusCode)
+	}
+
+	// closing the accepted connection frees its slot
+	held.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the connection to be accepted once a slot was released")
+	}
+}
@@ -0,0 +1,20 @@
+package xserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var xserver_rejections_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "x",
+		Subsystem: "server",
+		Name:      "rejections_total",
+		Help:      "The total number of connections and requests rejected by the server limits.",
+	},
+	[]string{"listener", "reason"},
+)
+
+// RegisterMetrics exposes the rejected connections and requests for each listener and reason
+func RegisterMetrics() {
+	prometheus.MustRegister(xserver_rejections_total)
+}
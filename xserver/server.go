@@ -0,0 +1,134 @@
+package xserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Server is a HTTP server hardened against slow and abusive clients
+type Server struct {
+	*http.Server
+	Name   string
+	Config Config
+}
+
+// New returns a Server listening on address with the config timeouts and limits applied
+func New(name string, address string, handler http.Handler, config Config) *Server {
+	s := &Server{
+		Name:   name,
+		Config: config,
+	}
+	s.Server = &http.Server{
+		Addr:              address,
+		Handler:           s.limitBody(handler),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	return s
+}
+
+// ListenAndServe listens on the TCP address and applies the connection limits.
+// If a TLS certificate is configured the connections are served over TLS.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	ln = newLimitListener(ln, s.Name, s.Config.MaxConns, s.Config.MaxConnsPerIP)
+	if s.Config.TLSCertFile != "" {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = tlsConfig
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return s.Serve(ln)
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.Config.TLSCertFile, s.Config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if s.Config.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.Config.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("xserver: no certificates found in %s", s.Config.TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// limitBody rejects requests over the route body limit with 413
+func (s *Server) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.Config.BodyLimit(r.URL.Path)
+		if limit > 0 {
+			if r.ContentLength > limit {
+				xserver_rejections_total.WithLabelValues(s.Name, "body_size").Inc()
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			// chunked or lying clients are cut off while reading the body
+			r.Body = &limitedBody{
+				ReadCloser: r.Body,
+				remaining:  limit,
+				onExceed: func() {
+					xserver_rejections_total.WithLabelValues(s.Name, "body_size").Inc()
+				},
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ErrBodyTooLarge is returned by reads of a request body over the route limit,
+// handlers forwarding the body answer 413 when they fail with it
+var ErrBodyTooLarge = errors.New("xserver: request body too large")
+
+// limitedBody fails reads once the limit is exceeded
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	onExceed  func()
+	once      sync.Once
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte over the limit to detect bodies larger than allowed
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.once.Do(b.onExceed)
+		return n + int(b.remaining), ErrBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,91 @@
+package xserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitedBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		limit int64
+		read  int
+		err   error
+	}{
+		{"under the limit", "hello", 10, 5, nil},
+		{"at the limit", "hello", 5, 5, nil},
+		{"over the limit", "hello world", 5, 5, ErrBodyTooLarge},
+		{"empty", "", 5, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exceeded := 0
+			body := &limitedBody{
+				ReadCloser: ioutil.NopCloser(strings.NewReader(tt.body)),
+				remaining:  tt.limit,
+				onExceed:   func() { exceeded++ },
+			}
+			data, err := ioutil.ReadAll(body)
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if len(data) != tt.read {
+				t.Fatalf("expected %v bytes, got %v", tt.read, len(data))
+			}
+			// later reads keep failing without counting the rejection again
+			if _, err := body.Read(make([]byte, 1)); tt.err != nil && err != tt.err {
+				t.Fatalf("expected %v on the next read, got %v", tt.err, err)
+			}
+			if want := map[bool]int{true: 1, false: 0}[tt.err != nil]; exceeded != want {
+				t.Fatalf("expected the rejection to be counted %v times, got %v", want, exceeded)
+			}
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBodyBytes = 8
+	config.RouteBodyLimits = map[string]int64{"/upload": 32}
+	s := New("test", ":0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err == ErrBodyTooLarge {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		}
+	}), config)
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		chunked bool
+		status  int
+	}{
+		{"under the default limit", "/", "small", false, http.StatusOK},
+		{"content length over the default limit", "/", "larger than eight", false, http.StatusRequestEntityTooLarge},
+		{"chunked over the default limit", "/", "larger than eight", true, http.StatusRequestEntityTooLarge},
+		{"under the route limit", "/upload/file", "larger than eight", false, http.StatusOK},
+		{"chunked over the route limit", "/upload/file", strings.Repeat("x", 64), true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = ioutil.NopCloser(body)
+			}
+			req := httptest.NewRequest("POST", tt.path, body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			s.Handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("expected %v, got %v", tt.status, w.Code)
+			}
+		})
+	}
+}
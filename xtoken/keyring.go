@@ -0,0 +1,188 @@
+package xtoken
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+	watch "github.com/hashicorp/consul/watch"
+)
+
+// Key is a token signing key stored in Consul KV as JSON, the key id is the KV key name.
+// HS256 keys hold a shared secret, EdDSA keys hold an Ed25519 public key and, on signers only, the private key.
+// If Service is set, the key can only sign tokens for that service.
+// Keys are rotated by adding a new active key and deactivating the old one,
+// inactive keys are still accepted for verification until removed from KV.
+type Key struct {
+	ID         string `json:"-"`
+	Alg        string `json:"alg"`
+	Service    string `json:"service,omitempty"`
+	Active     bool   `json:"active,omitempty"`
+	Secret     string `json:"secret,omitempty"`
+	PublicKey  string `json:"public,omitempty"`
+	PrivateKey string `json:"private,omitempty"`
+	secret     []byte
+	public     ed25519.PublicKey
+	private    ed25519.PrivateKey
+}
+
+func (k *Key) decode() error {
+	switch k.Alg {
+	case "HS256":
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil || len(secret) < 16 {
+			return errors.New("HS256 secret must be base64 encoded and at least 16 bytes long")
+		}
+		k.secret = secret
+		return nil
+	case "EdDSA":
+		public, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return errors.New("EdDSA public key must be a base64 encoded Ed25519 key")
+		}
+		k.public = ed25519.PublicKey(public)
+		if k.PrivateKey != "" {
+			private, err := base64.StdEncoding.DecodeString(k.PrivateKey)
+			if err != nil {
+				return errors.New("EdDSA private key must be base64 encoded")
+			}
+			switch len(private) {
+			case ed25519.SeedSize:
+				k.private = ed25519.NewKeyFromSeed(private)
+			case ed25519.PrivateKeySize:
+				k.private = ed25519.PrivateKey(private)
+			default:
+				return errors.New("EdDSA private key must be an Ed25519 seed or private key")
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", k.Alg)
+}
+
+// canSign returns true if the key holds the private part
+func (k Key) canSign() bool {
+	return len(k.secret) > 0 || len(k.private) > 0
+}
+
+func (k Key) sign(data []byte) ([]byte, error) {
+	switch k.Alg {
+	case "HS256":
+		return hmacSHA256(k.secret, data), nil
+	case "EdDSA":
+		if len(k.private) == 0 {
+			return nil, fmt.Errorf("xtoken: key %s has no private key", k.ID)
+		}
+		return ed25519.Sign(k.private, data), nil
+	}
+	return nil, fmt.Errorf("xtoken: unsupported algorithm %s", k.Alg)
+}
+
+func (k Key) verify(data []byte, signature []byte) bool {
+	switch k.Alg {
+	case "HS256":
+		return hmac.Equal(hmacSHA256(k.secret, data), signature)
+	case "EdDSA":
+		return ed25519.Verify(k.public, data, signature)
+	}
+	return false
+}
+
+// Keyring holds the signing keys loaded from a Consul KV prefix
+type Keyring struct {
+	Prefix    string
+	keys      map[string]Key
+	lock      sync.RWMutex
+	keysWatch *watch.WatchPlan
+}
+
+// NewKeyring returns an empty Keyring for the KV prefix
+func NewKeyring(prefix string) *Keyring {
+	return &Keyring{
+		Prefix: prefix,
+		keys:   make(map[string]Key),
+	}
+}
+
+// Get returns the key with the specified id
+func (k *Keyring) Get(id string) (Key, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// SigningKey returns the active key the service can sign with.
+// If more than one key is active the one with the greatest id wins, ids should sort by creation date.
+func (k *Keyring) SigningKey(service string) (Key, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	var signing Key
+	found := false
+	for id, key := range k.keys {
+		if !key.Active || !key.canSign() || (key.Service != "" && key.Service != service) {
+			continue
+		}
+		if !found || id > signing.ID {
+			signing = key
+			found = true
+		}
+	}
+	return signing, found
+}
+
+// Load replaces the keys with the ones decoded from the KV pairs, invalid keys are skipped
+func (k *Keyring) Load(pairs consul.KVPairs) {
+	keys := make(map[string]Key)
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		var key Key
+		if err := json.Unmarshal(pair.Value, &key); err != nil {
+			log.Warnf("xtoken: invalid key %s %s", pair.Key, err.Error())
+			continue
+		}
+		if err := key.decode(); err != nil {
+			log.Warnf("xtoken: invalid key %s %s", pair.Key, err.Error())
+			continue
+		}
+		key.ID = strings.TrimPrefix(pair.Key, k.Prefix)
+		keys[key.ID] = key
+	}
+	log.Infof("Token keyring loaded, %v keys", len(keys))
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = keys
+}
+
+// StartSync watches the KV prefix and reloads the keys on changes
+func (k *Keyring) StartSync() error {
+	keysWatch, err := watch.Parse(map[string]interface{}{"type": "keyprefix", "prefix": k.Prefix})
+	if err != nil {
+		return err
+	}
+	k.keysWatch = keysWatch
+	keysWatch.Handler = func(idx uint64, data interface{}) {
+		pairs, _ := data.(consul.KVPairs)
+		k.Load(pairs)
+	}
+	config := consul.DefaultConfig()
+	go keysWatch.Run(config.Address)
+	return nil
+}
+
+// Stop stops the KV watcher
+func (k *Keyring) Stop() {
+	if k.keysWatch != nil {
+		k.keysWatch.Stop()
+	}
+}
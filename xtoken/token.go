@@ -0,0 +1,149 @@
+package xtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// clock skew tolerated when validating token expiry
+const leeway = 5 * time.Second
+
+var (
+	// ErrMalformed is returned for tokens that can't be decoded
+	ErrMalformed = errors.New("xtoken: malformed token")
+	// ErrUnknownKey is returned when the key id is not in the keyring
+	ErrUnknownKey = errors.New("xtoken: unknown signing key")
+	// ErrSignature is returned when the signature doesn't match
+	ErrSignature = errors.New("xtoken: invalid signature")
+	// ErrExpired is returned for expired tokens
+	ErrExpired = errors.New("xtoken: token expired")
+	// ErrService is returned when the key is not allowed to sign for the token service
+	ErrService = errors.New("xtoken: key not allowed for service")
+	// ErrType is returned when the token is not of the expected type
+	ErrType = errors.New("xtoken: unexpected token type")
+	// ErrAudience is returned when the token was issued for another audience
+	ErrAudience = errors.New("xtoken: unexpected audience")
+)
+
+// token types, a token of one type is never accepted as the other
+const (
+	// ServiceToken is signed by a service to identify itself to the proxy
+	ServiceToken = "service"
+	// IdentityToken is signed by the proxy on behalf of the caller of an upstream service
+	IdentityToken = "identity"
+)
+
+// Claims is the service identity carried by a token.
+// Service is the signer, when the proxy signs on behalf of a caller the caller service,
+// the route and the original client identity are set as well.
+type Claims struct {
+	Type     string `json:"typ"`
+	Service  string `json:"iss"`
+	Caller   string `json:"caller,omitempty"`
+	Route    string `json:"route,omitempty"`
+	Subject  string `json:"sub,omitempty"`
+	Audience string `json:"aud,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// NewClaims returns claims of the token type for the signer service valid for ttl
+func NewClaims(typ string, service string, ttl time.Duration) Claims {
+	now := time.Now()
+	return Claims{
+		Type:     typ,
+		Service:  service,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+	}
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Sign creates a compact token signed with the key
+func Sign(claims Claims, key Key) (string, error) {
+	h, err := encodeSegment(header{Alg: key.Alg, Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := h + "." + c
+	signature, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token signature with the keyring and validates the type, audience, expiry and service binding
+func Verify(token string, keyring *Keyring, typ string, audience string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	key, ok := keyring.Get(h.Kid)
+	if !ok || key.Alg != h.Alg {
+		return nil, ErrUnknownKey
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrSignature
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if claims.Type != typ {
+		return nil, ErrType
+	}
+	if claims.Audience != audience {
+		return nil, ErrAudience
+	}
+	if time.Now().After(time.Unix(claims.Expires, 0).Add(leeway)) {
+		return nil, ErrExpired
+	}
+	if key.Service != "" && key.Service != claims.Service {
+		return nil, ErrService
+	}
+	return &claims, nil
+}
+
+func hmacSHA256(secret []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,156 @@
+package xtoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func testKeyring(t *testing.T, keys map[string]Key) *Keyring {
+	t.Helper()
+	keyring := NewKeyring("xmicro/servicekeys/")
+	pairs := make(consul.KVPairs, 0, len(keys))
+	for id, key := range keys {
+		value, _ := json.Marshal(key)
+		pairs = append(pairs, &consul.KVPair{Key: keyring.Prefix + id, Value: value})
+	}
+	keyring.Load(pairs)
+	return keyring
+}
+
+func testEdDSAKey(t *testing.T, active bool) Key {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key{
+		Alg:        "EdDSA",
+		Active:     active,
+		PublicKey:  base64.StdEncoding.EncodeToString(public),
+		PrivateKey: base64.StdEncoding.EncodeToString(private.Seed()),
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	keyring := testKeyring(t, map[string]Key{
+		"hs-1":    {Alg: "HS256", Active: true, Secret: testSecret},
+		"ed-1":    testEdDSAKey(t, true),
+		"proxy-1": {Alg: "HS256", Service: "xproxy", Active: true, Secret: testSecret},
+	})
+	sign := func(id string, claims Claims) string {
+		key, ok := keyring.Get(id)
+		if !ok {
+			t.Fatalf("key %s not loaded", id)
+		}
+		token, err := Sign(claims, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	claims := func(typ string, service string, audience string, ttl time.Duration) Claims {
+		c := NewClaims(typ, service, ttl)
+		c.Audience = audience
+		return c
+	}
+	valid := sign("hs-1", claims(ServiceToken, "xmicro-backend", "xmicro-storage", time.Minute))
+	parts := strings.Split(valid, ".")
+	tests := []struct {
+		name     string
+		token    string
+		typ      string
+		audience string
+		err      error
+	}{
+		{"HS256", valid, ServiceToken, "xmicro-storage", nil},
+		{"EdDSA", sign("ed-1", claims(ServiceToken, "xmicro-backend", "xmicro-storage", time.Minute)), ServiceToken, "xmicro-storage", nil},
+		{"key bound to the service", sign("proxy-1", claims(IdentityToken, "xproxy", "xmicro-frontend", time.Minute)), IdentityToken, "xmicro-frontend", nil},
+		{"key bound to another service", sign("proxy-1", claims(ServiceToken, "xmicro-backend", "xmicro-storage", time.Minute)), ServiceToken, "xmicro-storage", ErrService},
+		{"other type", valid, IdentityToken, "xmicro-storage", ErrType},
+		{"other audience", valid, ServiceToken, "xmicro-frontend", ErrAudience},
+		{"expired", sign("hs-1", claims(ServiceToken, "xmicro-backend", "xmicro-storage", -time.Minute)), ServiceToken, "xmicro-storage", ErrExpired},
+		{"expiry within leeway", sign("hs-1", claims(ServiceToken, "xmicro-backend", "xmicro-storage", -time.Second)), ServiceToken, "xmicro-storage", nil},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"service","iss":"xmicro-admin","aud":"xmicro-storage","exp":9999999999}`)) + "." + parts[2], ServiceToken, "xmicro-storage", ErrSignature},
+		{"unknown key", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"hs-0"}`)) + "." + parts[1] + "." + parts[2], ServiceToken, "xmicro-storage", ErrUnknownKey},
+		{"algorithm of another key", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"hs-1"}`)) + "." + parts[1] + "." + parts[2], ServiceToken, "xmicro-storage", ErrUnknownKey},
+		{"malformed", "token", ServiceToken, "xmicro-storage", ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Verify(tt.token, keyring, tt.typ, tt.audience)
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && claims.Audience != tt.audience {
+				t.Fatalf("expected audience %s, got %s", tt.audience, claims.Audience)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := Key{Alg: "HS256", Active: true, Secret: testSecret}
+	keyring := testKeyring(t, map[string]Key{"2024-01": old})
+	signing, ok := keyring.SigningKey("xmicro-backend")
+	if !ok || signing.ID != "2024-01" {
+		t.Fatalf("expected 2024-01 to sign, got %v %v", signing.ID, ok)
+	}
+	claims := NewClaims(ServiceToken, "xmicro-backend", time.Minute)
+	oldToken, _ := Sign(claims, signing)
+
+	// a new active key is added, the greatest id signs
+	keyring = testKeyring(t, map[string]Key{"2024-01": old, "2024-02": testEdDSAKey(t, true)})
+	if signing, _ := keyring.SigningKey("xmicro-backend"); signing.ID != "2024-02" {
+		t.Fatalf("expected 2024-02 to sign, got %v", signing.ID)
+	}
+
+	// the old key is deactivated, it no longer signs but still verifies
+	old.Active = false
+	keyring = testKeyring(t, map[string]Key{"2024-01": old, "2024-02": testEdDSAKey(t, true)})
+	if signing, _ := keyring.SigningKey("xmicro-backend"); signing.ID != "2024-02" {
+		t.Fatalf("expected 2024-02 to sign, got %v", signing.ID)
+	}
+	if _, err := Verify(oldToken, keyring, ServiceToken, ""); err != nil {
+		t.Fatalf("expected the inactive key to verify, got %v", err)
+	}
+
+	// the old key is removed from KV
+	keyring = testKeyring(t, map[string]Key{"2024-02": testEdDSAKey(t, true)})
+	if _, err := Verify(oldToken, keyring, ServiceToken, ""); err != ErrUnknownKey {
+		t.Fatalf("expected the removed key to be unknown, got %v", err)
+	}
+}
+
+func TestKeyringLoadSkipsInvalidKeys(t *testing.T) {
+	verifyOnly := testEdDSAKey(t, true)
+	verifyOnly.PrivateKey = ""
+	keyring := testKeyring(t, map[string]Key{
+		"short":       {Alg: "HS256", Active: true, Secret: base64.StdEncoding.EncodeToString([]byte("short"))},
+		"unsupported": {Alg: "RS256", Active: true, Secret: testSecret},
+		"verify-only": verifyOnly,
+		"proxy":       {Alg: "HS256", Service: "xproxy", Active: true, Secret: testSecret},
+	})
+	for _, id := range []string{"short", "unsupported"} {
+		if _, ok := keyring.Get(id); ok {
+			t.Fatalf("expected the invalid key %s to be skipped", id)
+		}
+	}
+	if _, ok := keyring.Get("verify-only"); !ok {
+		t.Fatal("expected the public key to be loaded")
+	}
+	// a key without the private part or bound to another service can't sign
+	if signing, ok := keyring.SigningKey("xmicro-backend"); ok {
+		t.Fatalf("expected no signing key, got %v", signing.ID)
+	}
+	if signing, ok := keyring.SigningKey("xproxy"); !ok || signing.ID != "proxy" {
+		t.Fatalf("expected the proxy key to sign for xproxy, got %v %v", signing.ID, ok)
+	}
+}